@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultPartition is the BigIP partition in which the objects are created.
+const defaultPartition = "Common"
+
+// auditRecord describes a change applied, or attempted, on the BigIP.
+type auditRecord struct {
+	Time        time.Time `json:"timestamp"`
+	Target      string    `json:"target"`
+	Partition   string    `json:"partition"`
+	Object      string    `json:"object"`
+	Action      string    `json:"action"`
+	OldChecksum string    `json:"old_checksum,omitempty"`
+	NewChecksum string    `json:"new_checksum,omitempty"`
+	Size        int64     `json:"size"`
+	Source      string    `json:"source"`
+	Event       string    `json:"event"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// auditLog is an append-only file of audit records written as JSON lines.
+// The file is rotated once it reaches its maximum size, the previous files
+// being renamed with the suffixes .1, .2, etc.
+type auditLog struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64 // no rotation when 0
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// openAuditLog opens, or creates, the audit log located at path. No audit log
+// is kept when path is empty.
+func openAuditLog(path string, maxSize int64, maxBackups int) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	a := &auditLog{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("cannot open audit log: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("cannot stat audit log: %v", err)
+	}
+	a.f = f
+	a.size = fi.Size()
+	return nil
+}
+
+// rotate closes the current file, shifts the backups and starts a new file.
+func (a *auditLog) rotate() error {
+	if err := a.f.Close(); err != nil {
+		return fmt.Errorf("cannot close audit log: %v", err)
+	}
+	if a.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", a.path, a.maxBackups))
+		for i := a.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+		}
+		if err := os.Rename(a.path, a.path+".1"); err != nil {
+			return fmt.Errorf("cannot rotate audit log: %v", err)
+		}
+	} else if err := os.Remove(a.path); err != nil {
+		return fmt.Errorf("cannot rotate audit log: %v", err)
+	}
+	return a.open()
+}
+
+// record appends rec to the audit log.
+func (a *auditLog) record(rec auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("cannot encode audit record: %v", err)
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.f.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("cannot write audit record: %v", err)
+	}
+	return nil
+}
+
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	a, err := openAuditLog(path, 0, 0)
+	if err != nil {
+		t.Fatalf("openAuditLog(%q): unexpected error %q", path, err.Error())
+	}
+	recs := []auditRecord{
+		{Object: "index.html", Action: "create", Result: "success"},
+		{Object: "index.html", Action: "delete", Result: "failure", Error: "boom"},
+	}
+	for _, rec := range recs {
+		if err := a.record(rec); err != nil {
+			t.Fatalf("auditLog.record(): unexpected error %q", err.Error())
+		}
+	}
+	if err := a.close(); err != nil {
+		t.Fatalf("auditLog.close(): unexpected error %q", err.Error())
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var i int
+	for sc := bufio.NewScanner(f); sc.Scan(); i++ {
+		var got auditRecord
+		if err := json.Unmarshal(sc.Bytes(), &got); err != nil {
+			t.Fatalf("line %d: cannot decode audit record: %v", i, err)
+		}
+		if i >= len(recs) {
+			continue
+		}
+		if got.Object != recs[i].Object || got.Action != recs[i].Action || got.Error != recs[i].Error {
+			t.Errorf("line %d: got %+v; want %+v", i, got, recs[i])
+		}
+	}
+	if i != len(recs) {
+		t.Errorf("auditLog: got %d records; want %d", i, len(recs))
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	a, err := openAuditLog(path, 1, 2)
+	if err != nil {
+		t.Fatalf("openAuditLog(%q): unexpected error %q", path, err.Error())
+	}
+	defer a.close()
+	for i := 0; i < 4; i++ {
+		if err := a.record(auditRecord{Object: "index.html"}); err != nil {
+			t.Fatalf("auditLog.record(): unexpected error %q", err.Error())
+		}
+	}
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("auditLog: missing file %q", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit.log.3")); !os.IsNotExist(err) {
+		t.Errorf("auditLog: got more than %d backups", 2)
+	}
+}
+
+func TestOpenAuditLogDisabled(t *testing.T) {
+	a, err := openAuditLog("", 0, 0)
+	if err != nil {
+		t.Fatalf("openAuditLog(\"\"): unexpected error %q", err.Error())
+	}
+	if a != nil {
+		t.Error("openAuditLog(\"\"): got non-nil audit log")
+	}
+}
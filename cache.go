@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// cacheEntry records what is known about a local file as of its last
+// observed size, modification time and inode.
+type cacheEntry struct {
+	Size    int64             `json:"size"`
+	ModTime int64             `json:"mtime"`
+	Inode   uint64            `json:"inode,omitempty"`
+	Digests map[string]string `json:"digests,omitempty"` // hex digest per algorithm
+	Remotes map[string]string `json:"remotes,omitempty"` // last known remote checksum per BigIP
+}
+
+func (ce *cacheEntry) matches(fi os.FileInfo) bool {
+	return ce.Size == fi.Size() && ce.ModTime == fi.ModTime().UnixNano() && ce.Inode == inode(fi)
+}
+
+// hashCache is a persistent cache of the digests of local files, saved as
+// JSON. It avoids re-reading and re-hashing files that did not change since
+// they were last synchronised. A nil *hashCache is valid and caches nothing.
+type hashCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*cacheEntry
+	dirty   bool
+}
+
+// loadHashCache reads the cache stored at path. A missing file results in an
+// empty cache. No cache is used when path is empty.
+func loadHashCache(path string) (*hashCache, error) {
+	if path == "" {
+		return nil, nil
+	}
+	c := &hashCache{path: path, entries: make(map[string]*cacheEntry)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read cache file %q: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, fmt.Errorf("cannot decode cache file %q: %v", path, err)
+	}
+	return c, nil
+}
+
+// entry returns the entry of the file located at path, provided that the file
+// did not change since the entry was recorded. Callers must hold c.mu.
+func (c *hashCache) entry(path string, fi os.FileInfo) *cacheEntry {
+	ce, ok := c.entries[path]
+	if !ok || !ce.matches(fi) {
+		return nil
+	}
+	return ce
+}
+
+// isSynced reports whether the file located at path, described by fi, did not
+// change since it was last found identical to its counterpart on the BigIP
+// located at target.
+func (c *hashCache) isSynced(target, path string, fi os.FileInfo) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ce := c.entry(path, fi)
+	if ce == nil || ce.Remotes[target] == "" {
+		return false
+	}
+	algo, _, checksum := splitChecksum(ce.Remotes[target])
+	return ce.Digests[strings.ToLower(algo)] == checksum
+}
+
+// checksum returns the digest of the file located at path computed with the
+// given algorithm, re-using the cached value when the file did not change.
+func (c *hashCache) checksum(path, algo string) (string, error) {
+	if c == nil {
+		return fileChecksum(path, algo)
+	}
+	algo = strings.ToLower(algo)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot stat file %q: %v", path, err)
+	}
+
+	c.mu.Lock()
+	if ce := c.entry(path, fi); ce != nil {
+		if digest, ok := ce.Digests[algo]; ok {
+			c.mu.Unlock()
+			return digest, nil
+		}
+	}
+	c.mu.Unlock()
+
+	digest, err := fileChecksum(path, algo)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ce := c.entry(path, fi)
+	if ce == nil {
+		ce = &cacheEntry{
+			Size:    fi.Size(),
+			ModTime: fi.ModTime().UnixNano(),
+			Inode:   inode(fi),
+			Digests: make(map[string]string),
+		}
+		c.entries[path] = ce
+	}
+	ce.Digests[algo] = digest
+	c.dirty = true
+	return digest, nil
+}
+
+// setRemote records the checksum last reported by the BigIP located at target
+// for the file located at path.
+func (c *hashCache) setRemote(target, path, checksum string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ce, ok := c.entries[path]
+	if !ok || ce.Remotes[target] == checksum {
+		return
+	}
+	if ce.Remotes == nil {
+		ce.Remotes = make(map[string]string)
+	}
+	ce.Remotes[target] = checksum
+	c.dirty = true
+}
+
+// forget removes the file located at path from the cache.
+func (c *hashCache) forget(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[path]; ok {
+		delete(c.entries, path)
+		c.dirty = true
+	}
+}
+
+// save writes the cache to disk if it changed since it was last saved.
+func (c *hashCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return fmt.Errorf("cannot encode cache: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("cannot create cache file: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot write cache file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot write cache file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot write cache file: %v", err)
+	}
+	c.dirty = false
+	return nil
+}
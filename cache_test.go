@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "index.html")
+	if err := ioutil.WriteFile(path, []byte("test"), 0644); err != nil {
+		t.Fatal("setup: ", err)
+	}
+	cachePath := filepath.Join(dir, "cache.json")
+	target := "https://10.0.0.1"
+
+	cache, err := loadHashCache(cachePath)
+	if err != nil {
+		t.Fatalf("loadHashCache(%q): unexpected error %q", cachePath, err.Error())
+	}
+	want := "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3" // sha1("test")
+	got, err := cache.checksum(path, "SHA1")
+	if err != nil {
+		t.Fatalf("hashCache.checksum(%q): unexpected error %q", path, err.Error())
+	}
+	if got != want {
+		t.Errorf("hashCache.checksum(%q): got %q; want %q", path, got, want)
+	}
+	cache.setRemote(target, path, "SHA1:4:"+want)
+	if err := cache.save(); err != nil {
+		t.Fatalf("hashCache.save(): unexpected error %q", err.Error())
+	}
+
+	// Reload the cache from disk to make sure it is persisted.
+	cache, err = loadHashCache(cachePath)
+	if err != nil {
+		t.Fatalf("loadHashCache(%q): unexpected error %q", cachePath, err.Error())
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	if !cache.isSynced(target, path, fi) {
+		t.Errorf("hashCache.isSynced(%q): got false; want true", path)
+	}
+	// The remote checksum is only trusted for the BigIP that reported it.
+	if other := "https://10.0.0.2"; cache.isSynced(other, path, fi) {
+		t.Errorf("hashCache.isSynced(%q, %q): got true for another BigIP; want false", other, path)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("modified content"), 0644); err != nil {
+		t.Fatal("setup: ", err)
+	}
+	fi, err = os.Stat(path)
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	if cache.isSynced(target, path, fi) {
+		t.Errorf("hashCache.isSynced(%q): got true after modification; want false", path)
+	}
+}
+
+func TestHashCache_Nil(t *testing.T) {
+	cache, err := loadHashCache("")
+	if err != nil {
+		t.Fatalf("loadHashCache(%q): unexpected error %q", "", err.Error())
+	}
+	if cache != nil {
+		t.Fatalf("loadHashCache(%q): got %v; want nil", "", cache)
+	}
+	if cache.isSynced("https://10.0.0.1", "/some/path", nil) {
+		t.Error("(*hashCache)(nil).isSynced(): got true; want false")
+	}
+	if err := cache.save(); err != nil {
+		t.Errorf("(*hashCache)(nil).save(): unexpected error %q", err.Error())
+	}
+}
@@ -2,11 +2,31 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
+// duration wraps a time.Duration so that it can be decoded from a string such
+// as "500ms" or "2s".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
 type f5Config struct {
 	AuthMethod        string `toml:"auth_method"`
 	URL               string `toml:"url"`
@@ -17,31 +37,325 @@ type f5Config struct {
 }
 
 type watchConfig struct {
-	Dir               string   `toml:"directory"`
-	Exclude           []string `toml:"exclude"`
-	RemoveRemoveFiles bool     `toml:"remove_remote_files"`
+	Type              string            `toml:"type"` // name of the object handler, "ifile" by default
+	Dir               string            `toml:"directory"`
+	Include           []string          `toml:"include"` // only these files when set
+	Exclude           []string          `toml:"exclude"`
+	RemoveRemoveFiles bool              `toml:"remove_remote_files"`
+	ForceDelete       bool              `toml:"force_delete"` // delete objects even if still referenced
+	Debounce          duration          `toml:"debounce"`
+	PreHook           string            `toml:"pre_hook"`  // shell command, blocks the upload on failure
+	PostHook          string            `toml:"post_hook"` // shell command, run once the upload is verified
+	HookTimeout       duration          `toml:"hook_timeout"`
+	MaxSizeKB         int64             `toml:"max_size_kb"`        // no limit when 0
+	AllowedExtensions []string          `toml:"allowed_extensions"` // e.g. [".html", ".json"]
+	AllowedTypes      []string          `toml:"allowed_types"`      // media types, e.g. ["text/*"]
+	TextOnly          bool              `toml:"text_only"`          // refuse NUL bytes and invalid UTF-8
+	Transform         []string          `toml:"transform"`          // "template", "minify" and "gzip", applied in order
+	TemplateVars      map[string]string `toml:"template_vars"`
+	GzipMinSizeKB     int64             `toml:"gzip_min_size_kb"` // smaller files are not compressed
+	ScanWorkers       int               `toml:"scan_workers"`     // files compared concurrently during scans
+}
+
+// ilxConfig describes a local directory tree synchronised with the extension
+// of an iRules LX workspace.
+type ilxConfig struct {
+	Dir       string   `toml:"directory"`
+	Workspace string   `toml:"workspace"`
+	Extension string   `toml:"extension"`
+	Plugin    string   `toml:"plugin"` // reloaded when set
+	Include   []string `toml:"include"`
+	Exclude   []string `toml:"exclude"`
+	Debounce  duration `toml:"debounce"`
+}
+
+// logSinkConfig configures an additional destination of the logs.
+type logSinkConfig struct {
+	Type     string `toml:"type"`     // "stderr", "syslog" or "journald"
+	Level    string `toml:"level"`    // minimum level, same as the logs by default
+	Format   string `toml:"format"`   // stderr only: "text" or "json"
+	Network  string `toml:"network"`  // syslog only: "unixgram", "unix", "udp" or "tcp"
+	Address  string `toml:"address"`  // syslog only
+	Facility string `toml:"facility"` // syslog only, "daemon" by default
+	Tag      string `toml:"tag"`      // syslog and journald identifier
+}
+
+// logConfig configures the operational logs.
+type logConfig struct {
+	Level  string `toml:"level"`  // "debug", "info", "notice", "warn" or "error"
+	Format string `toml:"format"` // "text" or "json"
+
+	// Sinks replace the standard error output when given.
+	Sinks []logSinkConfig `toml:"sink"`
+}
+
+// metricsConfig configures the optional Prometheus metrics endpoint.
+type metricsConfig struct {
+	Listen               string   `toml:"listen"` // disabled when empty
+	Path                 string   `toml:"path"`
+	ReachabilityInterval duration `toml:"reachability_interval"`
+}
+
+// healthConfig configures the optional health and readiness endpoints.
+type healthConfig struct {
+	Listen        string `toml:"listen"` // disabled when empty
+	MaxRetryQueue int    `toml:"max_retry_queue"`
+}
+
+// controlConfig configures the optional control API.
+type controlConfig struct {
+	// Listen is either a TCP address, which must be a loopback one, or a
+	// unix socket path prefixed with "unix:". Disabled when empty.
+	Listen string `toml:"listen"`
+}
+
+// auditConfig configures the audit trail of the changes applied to the BigIP.
+type auditConfig struct {
+	File       string `toml:"file"` // disabled when empty
+	MaxSizeMB  int    `toml:"max_size_mb"`
+	MaxBackups int    `toml:"max_backups"`
+}
+
+// uploadConfig configures the chunked uploads of the files to the BigIP.
+type uploadConfig struct {
+	ChunkSizeKB  int64    `toml:"chunk_size_kb"` // at most 1024
+	ChunkRetries int      `toml:"chunk_retries"`
+	RetryDelay   duration `toml:"retry_delay"` // doubled after each attempt
+}
+
+// notifyConfig configures a webhook notified of the changes applied to the
+// BigIP.
+type notifyConfig struct {
+	Type        string   `toml:"type"` // slack, teams or generic
+	URL         string   `toml:"url"`
+	Events      []string `toml:"events"`
+	Template    string   `toml:"template"`
+	MinInterval duration `toml:"min_interval"`
+	MaxRetries  int      `toml:"max_retries"` // retries disabled when negative
+	Timeout     duration `toml:"timeout"`
 }
 
 type config struct {
+	// Include lists glob patterns, relative to the directory of the
+	// configuration file, of files defining additional watches, ilx watches
+	// and webhooks.
+	Include []string `toml:"include"`
+
 	F5 f5Config `toml:"f5"`
 
-	CredentialStorage string `toml:"credential_storage"` // "plain" or "secret"
+	CredentialStorage string `toml:"credential_storage"` // "plain" (default) or "secret"
 	SecretStorePath   string `toml:"secret_store_path"`  // when CredentialStorage is "secret"
 	Passphrase        string `toml:"token"`              // when CredentialStorage is "secret"
 
+	CacheFile string `toml:"cache_file"` // local hash cache, disabled when empty
+
+	Log     logConfig      `toml:"log"`
+	Metrics metricsConfig  `toml:"metrics"`
+	Health  healthConfig   `toml:"health"`
+	Control controlConfig  `toml:"control"`
+	Audit   auditConfig    `toml:"audit"`
+	Upload  uploadConfig   `toml:"upload"`
+	Notify  []notifyConfig `toml:"notify"`
+
 	Watch []watchConfig `toml:"watch"`
+	ILX   []ilxConfig   `toml:"ilx"`
+
+	path    string              // of the main configuration file
+	origins map[string][]origin // by array of tables, e.g. "watch"
+}
+
+// configFragment is the content allowed in an included configuration file.
+type configFragment struct {
+	Notify []notifyConfig `toml:"notify"`
+	Watch  []watchConfig  `toml:"watch"`
+	ILX    []ilxConfig    `toml:"ilx"`
+}
+
+// origin locates an element of an array of tables within the configuration
+// files.
+type origin struct {
+	file  string
+	index int
+}
+
+// key returns the path of the i-th element of the given array of tables,
+// prefixed by the file in which it is defined.
+func (cfg *config) key(table string, i int) string {
+	o := origin{file: cfg.path, index: i}
+	if i < len(cfg.origins[table]) {
+		o = cfg.origins[table][i]
+	}
+	return fmt.Sprintf("%s: %s[%d]", o.file, table, o.index)
+}
+
+// addOrigins records that the n elements just appended to the given array of
+// tables have been read from file.
+func (cfg *config) addOrigins(table, file string, n int) {
+	for i := 0; i < n; i++ {
+		cfg.origins[table] = append(cfg.origins[table], origin{file: file, index: i})
+	}
+}
+
+// envRegexp matches the references to environment variables, ${NAME} or
+// ${NAME:-default}, as well as the escaped sequence $${.
+var envRegexp = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces the references to environment variables in s by their
+// values. Unset variables are replaced by their default value, if any, or by
+// an empty string.
+func expandEnv(s string) string {
+	return envRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		m := envRegexp.FindStringSubmatch(ref)
+		if v := os.Getenv(m[1]); v != "" {
+			return v
+		}
+		return m[3]
+	})
+}
+
+// expandEnvValues expands the environment variables referenced by the string
+// values found in v, as decoded by parseDocument.
+func expandEnvValues(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return expandEnv(v)
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = expandEnvValues(e)
+		}
+	case []map[string]interface{}:
+		for _, e := range v {
+			expandEnvValues(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = expandEnvValues(e)
+		}
+	}
+	return v
+}
+
+// decodeConfigFile decodes the configuration file located at path into v. The
+// environment variables are expanded in the string values only, once the file
+// has been parsed, so that their values are never interpreted as syntax. The
+// format of the file is given by its extension unless format is set.
+func decodeConfigFile(path, format string, v interface{}) (toml.MetaData, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return toml.MetaData{}, errors.New("cannot open configuration file: " + err.Error())
+	}
+	if format == "" {
+		format = configFormatOf(path)
+	}
+	switch format {
+	case "toml", "yaml", "yml", "json":
+	default:
+		return toml.MetaData{}, fmt.Errorf("unsupported configuration format %q", format)
+	}
+	doc, err := parseDocument(data, format)
+	if err != nil {
+		return toml.MetaData{}, errors.New("cannot read configuration file: " + err.Error())
+	}
+	text, err := encodeTOML(expandEnvValues(doc).(map[string]interface{}))
+	if err != nil {
+		return toml.MetaData{}, errors.New("cannot read configuration file: " + err.Error())
+	}
+	md, err := toml.Decode(text, v)
+	if err != nil {
+		return md, errors.New("cannot read configuration file: " + err.Error())
+	}
+	return md, nil
+}
+
+// includedFiles returns the files matching the include patterns, sorted by
+// name within each pattern, without duplicates.
+func includedFiles(path string, patterns []string) ([]string, error) {
+	seen := map[string]bool{filepath.Clean(path): true}
+	var files []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include pattern %q: %v", pattern, err)
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
+	}
+	return files, nil
 }
 
 func readConfig(path string) (*config, error) {
-	file, err := os.Open(path)
+	return readConfigFormat(path, *configFormat)
+}
+
+// readConfigFormat reads the configuration file located at path, written in
+// the given format: "toml", "yaml" or "json". The format of the file, as well
+// as the one of the included files, is given by its extension when format is
+// empty.
+func readConfigFormat(path, format string) (*config, error) {
+	cfg := config{
+		Metrics: metricsConfig{
+			Path:                 "/metrics",
+			ReachabilityInterval: duration{defaultReachabilityInterval},
+		},
+		Health: healthConfig{
+			MaxRetryQueue: defaultMaxRetryQueue,
+		},
+		Audit: auditConfig{
+			MaxSizeMB:  100,
+			MaxBackups: 10,
+		},
+		Upload: uploadConfig{
+			ChunkSizeKB:  maxChunkSize / 1024,
+			ChunkRetries: defaultChunkRetries,
+			RetryDelay:   duration{defaultChunkRetryDelay},
+		},
+		path:    path,
+		origins: make(map[string][]origin),
+	}
+	md, err := decodeConfigFile(path, format, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	var errs configErrors
+	errs.addUndecoded(path, md)
+	cfg.addOrigins("notify", path, len(cfg.Notify))
+	cfg.addOrigins("watch", path, len(cfg.Watch))
+	cfg.addOrigins("ilx", path, len(cfg.ILX))
+
+	files, err := includedFiles(path, cfg.Include)
 	if err != nil {
-		return nil, errors.New("cannot open configuration file: " + err.Error())
+		return nil, err
+	}
+	for _, file := range files {
+		var frag configFragment
+		md, err := decodeConfigFile(file, "", &frag)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		errs.addUndecoded(file, md)
+		cfg.Notify = append(cfg.Notify, frag.Notify...)
+		cfg.Watch = append(cfg.Watch, frag.Watch...)
+		cfg.ILX = append(cfg.ILX, frag.ILX...)
+		cfg.addOrigins("notify", file, len(frag.Notify))
+		cfg.addOrigins("watch", file, len(frag.Watch))
+		cfg.addOrigins("ilx", file, len(frag.ILX))
 	}
-	defer file.Close()
 
-	var cfg config
-	if _, err := toml.DecodeReader(file, &cfg); err != nil {
-		return nil, errors.New("cannot read configuration file: " + err.Error())
+	if cfg.CredentialStorage == "" {
+		cfg.CredentialStorage = "plain"
+	}
+	if err := validateConfig(&cfg, errs); err != nil {
+		return nil, err
 	}
 
 	return &cfg, nil
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -114,3 +116,299 @@ func testReadConfigFailDecode(t *testing.T, invalidFile *os.File) {
 		t.Errorf("readConfig(%q): got error %q; want %q", path, err.Error(), wantErr)
 	}
 }
+
+func TestReadConfigValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := createTempConfigFile(`
+[f5]
+auth_method = "ntlm"
+url = "https://bigip"
+user = "admin"
+
+[[notify]]
+url = "https://hooks.example.com"
+min_interval = "30s"
+
+[[watch]]
+directory = "` + filepath.ToSlash(dir) + `"
+remove_remote_file = true
+debounce = "1s"
+include = ["*.html", "dir/**/*.html"]
+
+[[watch]]
+exclude = ["[a-"]
+
+[[ilx]]
+directory = "` + filepath.ToSlash(dir) + `"
+workspace = "ws; rm -rf /"
+extension = "ext"
+`)
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = readConfig(f.Name())
+	if err == nil {
+		t.Fatalf("readConfig(%q): expected error, got nil", f.Name())
+	}
+	for _, want := range []string{
+		"watch.remove_remote_file: unknown key",
+		`f5.auth_method: unsupported auth method "ntlm"`,
+		"watch[1].directory: missing value",
+		`watch[1].exclude[0]: invalid pattern "[a-"`,
+		`watch[0].include[1]: pattern "dir/**/*.html" matches files of sub-directories`,
+		`ilx[0].workspace: invalid workspace name "ws; rm -rf /"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("readConfig(%q): error does not contain %q:\n%s", f.Name(), want, err.Error())
+		}
+	}
+	for _, unwanted := range []string{"debounce", "min_interval", "watch[0].directory"} {
+		if strings.Contains(err.Error(), unwanted) {
+			t.Errorf("readConfig(%q): unexpected error about %q:\n%s", f.Name(), unwanted, err.Error())
+		}
+	}
+}
+
+func TestCheckControlListen(t *testing.T) {
+	tests := []struct {
+		addr  string
+		valid bool
+	}{
+		{"127.0.0.1:9300", true},
+		{"[::1]:9300", true},
+		{"localhost:9300", true},
+		{"unix:/run/f5-auto-uploader/control.sock", true},
+		{":9300", false},
+		{"0.0.0.0:9300", false},
+		{"192.168.1.10:9300", false},
+		{"example.com:9300", false},
+		{"127.0.0.1", false},
+		{"unix:", false},
+	}
+	for _, test := range tests {
+		err := checkControlListen(test.addr)
+		if test.valid && err != nil {
+			t.Errorf("checkControlListen(%q): unexpected error %q", test.addr, err.Error())
+		} else if !test.valid && err == nil {
+			t.Errorf("checkControlListen(%q): expected error, got nil", test.addr)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("F5_AUTO_UPLOADER_TEST_URL", "https://bigip")
+	os.Unsetenv("F5_AUTO_UPLOADER_TEST_UNSET")
+	defer os.Unsetenv("F5_AUTO_UPLOADER_TEST_URL")
+
+	tests := []struct {
+		in, want string
+	}{
+		{`url = "${F5_AUTO_UPLOADER_TEST_URL}"`, `url = "https://bigip"`},
+		{`url = "${F5_AUTO_UPLOADER_TEST_URL:-https://other}"`, `url = "https://bigip"`},
+		{`user = "${F5_AUTO_UPLOADER_TEST_UNSET:-admin}"`, `user = "admin"`},
+		{`user = "${F5_AUTO_UPLOADER_TEST_UNSET}"`, `user = ""`},
+		{`password = "pa$${word}"`, `password = "pa${word}"`},
+		{`password = "pa$$word"`, `password = "pa$$word"`},
+	}
+	for _, test := range tests {
+		if got := expandEnv(test.in); got != test.want {
+			t.Errorf("expandEnv(%q): got %q; want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestReadConfigInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "conf.d"), 0755); err != nil {
+		t.Fatal("setup: ", err)
+	}
+	os.Setenv("F5_AUTO_UPLOADER_TEST_DIR", filepath.ToSlash(dir))
+	defer os.Unsetenv("F5_AUTO_UPLOADER_TEST_DIR")
+
+	files := map[string]string{
+		"config.toml": `include = ["conf.d/*.toml"]
+` + validConfigFileContent + `
+[[watch]]
+directory = "${F5_AUTO_UPLOADER_TEST_DIR}"
+`,
+		"conf.d/b.toml": `
+[[watch]]
+directory = "${F5_AUTO_UPLOADER_TEST_DIR}/conf.d"
+`,
+		"conf.d/a.toml": `
+[[watch]]
+directory = "${F5_AUTO_UPLOADER_TEST_DIR}/missing"
+`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal("setup: ", err)
+		}
+	}
+	path := filepath.Join(dir, "config.toml")
+
+	// The error must point to the included file and to the index of the
+	// watch within that file.
+	_, err = readConfig(path)
+	if err == nil {
+		t.Fatalf("readConfig(%q): expected error, got nil", path)
+	}
+	want := filepath.Join(dir, "conf.d", "a.toml") + ": watch[0].directory: cannot open directory"
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("readConfig(%q): error does not contain %q:\n%s", path, want, err.Error())
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "missing"), 0755); err != nil {
+		t.Fatal("setup: ", err)
+	}
+	cfg, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("readConfig(%q): unexpected error %q", path, err.Error())
+	}
+	var got []string
+	for _, w := range cfg.Watch {
+		got = append(got, w.Dir)
+	}
+	slash := filepath.ToSlash(dir)
+	wantDirs := []string{slash, slash + "/missing", slash + "/conf.d"}
+	if strings.Join(got, ",") != strings.Join(wantDirs, ",") {
+		t.Errorf("readConfig(%q): got watches %q; want %q", path, got, wantDirs)
+	}
+}
+
+func TestReadConfigFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+	slash := filepath.ToSlash(dir)
+
+	files := map[string]string{
+		"config.toml": `
+[f5]
+auth_method = "basic"
+url = "https://bigip"
+user = "admin"
+
+[log]
+level = "debug"
+
+[[watch]]
+directory = "` + slash + `"
+exclude = [".*", "*.swp"]
+debounce = "2s"
+`,
+		"config.yaml": `
+f5:
+  auth_method: basic
+  url: https://bigip
+  user: admin
+log:
+  level: debug
+watch:
+  - directory: ` + slash + `
+    exclude: [".*", "*.swp"]
+    debounce: 2s
+    hook_timeout: ~
+`,
+		"config.json": `{
+  "f5": {"auth_method": "basic", "url": "https://bigip", "user": "admin"},
+  "log": {"level": "debug"},
+  "watch": [{"directory": "` + slash + `", "exclude": [".*", "*.swp"], "debounce": "2s"}]
+}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal("setup: ", err)
+		}
+	}
+
+	want, err := readConfig(filepath.Join(dir, "config.toml"))
+	if err != nil {
+		t.Fatalf("readConfig(config.toml): unexpected error %q", err.Error())
+	}
+	for _, name := range []string{"config.yaml", "config.json"} {
+		path := filepath.Join(dir, name)
+		got, err := readConfig(path)
+		if err != nil {
+			t.Errorf("readConfig(%q): unexpected error %q", path, err.Error())
+			continue
+		}
+		if got.F5 != want.F5 || got.Log.Level != want.Log.Level || got.Metrics.Path != want.Metrics.Path {
+			t.Errorf("readConfig(%q): got %+v; want %+v", path, got, want)
+		}
+		if len(got.Watch) != 1 || got.Watch[0].Dir != slash ||
+			got.Watch[0].Debounce.Duration != want.Watch[0].Debounce.Duration ||
+			strings.Join(got.Watch[0].Exclude, ",") != strings.Join(want.Watch[0].Exclude, ",") {
+			t.Errorf("readConfig(%q): got watches %+v; want %+v", path, got.Watch, want.Watch)
+		}
+	}
+
+	// The format given explicitly takes precedence over the extension, and
+	// unknown keys are reported whatever the format.
+	path := filepath.Join(dir, "config.conf")
+	content := `{"f5": {"auth_method": "basic", "url": "https://bigip", "user": "admin", "passwd": "x"}}`
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal("setup: ", err)
+	}
+	_, err = readConfigFormat(path, "json")
+	if err == nil || !strings.Contains(err.Error(), "f5.passwd: unknown key") {
+		t.Errorf("readConfigFormat(%q, \"json\"): got error %v; want unknown key error", path, err)
+	}
+}
+
+func TestReadConfigExpandEnvValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+	value := `pa"ss\word` + "\nuser = \"root\""
+	os.Setenv("F5_AUTO_UPLOADER_TEST_PASSWORD", value)
+	defer os.Unsetenv("F5_AUTO_UPLOADER_TEST_PASSWORD")
+
+	files := map[string]string{
+		"config.toml": `# The password is read from ${F5_AUTO_UPLOADER_TEST_PASSWORD}.
+[f5]
+auth_method = "basic"
+url = "https://bigip"
+user = "admin"
+password = "${F5_AUTO_UPLOADER_TEST_PASSWORD}"
+`,
+		"config.yaml": `# The password is read from ${F5_AUTO_UPLOADER_TEST_PASSWORD}.
+f5:
+  auth_method: basic
+  url: https://bigip
+  user: admin
+  password: ${F5_AUTO_UPLOADER_TEST_PASSWORD}
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal("setup: ", err)
+		}
+		cfg, err := readConfig(path)
+		if err != nil {
+			t.Errorf("readConfig(%q): unexpected error %q", path, err.Error())
+			continue
+		}
+		if cfg.F5.Password != value || cfg.F5.User != "admin" {
+			t.Errorf("readConfig(%q): got user %q and password %q; want %q and %q",
+				path, cfg.F5.User, cfg.F5.Password, "admin", value)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configFormatOf returns the format of the configuration file located at
+// path according to its extension. TOML is assumed by default.
+func configFormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".json":
+		return "json"
+	default:
+		return "toml"
+	}
+}
+
+// parseDocument parses a TOML, YAML or JSON document into a map. YAML and
+// JSON documents are normalized so that, once encoded back into TOML by
+// encodeTOML, they are decoded and validated exactly like a TOML
+// configuration file.
+func parseDocument(data []byte, format string) (map[string]interface{}, error) {
+	if format == "toml" {
+		m := make(map[string]interface{})
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	var v interface{}
+	var err error
+	if format == "json" {
+		err = json.Unmarshal(data, &v)
+	} else {
+		err = yaml.Unmarshal(data, &v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return make(map[string]interface{}), nil
+	}
+	m, ok := normalizeValue(v).(map[string]interface{})
+	if !ok {
+		return nil, errors.New("the document must be a mapping")
+	}
+	return m, nil
+}
+
+// encodeTOML encodes m, as returned by parseDocument, into TOML.
+func encodeTOML(m map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(m); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// normalizeValue converts the values decoded from YAML and JSON into the types
+// expected by the TOML encoder: maps are keyed by strings, lists of maps
+// become arrays of tables, integral numbers become integers and null values
+// are dropped.
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if e != nil {
+				m[fmt.Sprint(k)] = normalizeValue(e)
+			}
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if e != nil {
+				m[k] = normalizeValue(e)
+			}
+		}
+		return m
+	case []interface{}:
+		var (
+			values = make([]interface{}, 0, len(v))
+			tables = make([]map[string]interface{}, 0, len(v))
+		)
+		for _, e := range v {
+			e = normalizeValue(e)
+			values = append(values, e)
+			if t, ok := e.(map[string]interface{}); ok {
+				tables = append(tables, t)
+			}
+		}
+		if len(v) > 0 && len(tables) == len(v) {
+			return tables
+		}
+		return values
+	case int:
+		return int64(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// controlWatchStatus is the JSON representation of the status of a watch.
+type controlWatchStatus struct {
+	Directory  string                `json:"directory"`
+	Paused     bool                  `json:"paused"`
+	Held       int                   `json:"held_events"`
+	RetryQueue int                   `json:"retry_queue"`
+	Files      map[string]fileStatus `json:"files"`
+}
+
+// controller implements the control API through which watches can be paused,
+// resumed, resynchronised and inspected at runtime.
+type controller struct {
+	mu      sync.Mutex
+	syncers []*syncer
+}
+
+func (c *controller) add(s *syncer) {
+	c.mu.Lock()
+	c.syncers = append(c.syncers, s)
+	c.mu.Unlock()
+}
+
+func (c *controller) remove(s *syncer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, cs := range c.syncers {
+		if cs == s {
+			c.syncers = append(c.syncers[:i], c.syncers[i+1:]...)
+			return
+		}
+	}
+}
+
+// lookup returns the syncers of the watch matching dir, or all of them when
+// dir is empty.
+func (c *controller) lookup(dir string) ([]*syncer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if dir == "" {
+		return append([]*syncer(nil), c.syncers...), nil
+	}
+	for _, s := range c.syncers {
+		if s.cfg.Dir == dir {
+			return []*syncer{s}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown watch %q", dir)
+}
+
+func (c *controller) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", c.serveStatus)
+	mux.HandleFunc("/v1/pause", c.servePause)
+	mux.HandleFunc("/v1/resume", c.serveResume)
+	mux.HandleFunc("/v1/resync", c.serveResync)
+	return mux
+}
+
+func (c *controller) serveStatus(w http.ResponseWriter, r *http.Request) {
+	syncers, err := c.lookup(r.URL.Query().Get("watch"))
+	if err != nil {
+		writeControlError(w, http.StatusNotFound, err)
+		return
+	}
+	resp := make([]controlWatchStatus, 0, len(syncers))
+	for _, s := range syncers {
+		paused, held := s.isPaused()
+		resp = append(resp, controlWatchStatus{
+			Directory:  s.cfg.Dir,
+			Paused:     paused,
+			Held:       held,
+			RetryQueue: s.retries.len(),
+			Files:      s.status(),
+		})
+	}
+	writeControlResponse(w, resp)
+}
+
+func (c *controller) servePause(w http.ResponseWriter, r *http.Request) {
+	c.apply(w, r, "paused", func(s *syncer) error {
+		s.pause()
+		return nil
+	})
+}
+
+func (c *controller) serveResume(w http.ResponseWriter, r *http.Request) {
+	c.apply(w, r, "resumed", func(s *syncer) error {
+		s.resume()
+		return nil
+	})
+}
+
+func (c *controller) serveResync(w http.ResponseWriter, r *http.Request) {
+	c.apply(w, r, "resynchronised", func(s *syncer) error {
+		if paused, _ := s.isPaused(); paused {
+			return fmt.Errorf("watch %q is paused", s.cfg.Dir)
+		}
+		return scanDir(s)
+	})
+}
+
+// apply runs fn on the watches selected by the request and reports the
+// outcome for each of them.
+func (c *controller) apply(w http.ResponseWriter, r *http.Request, done string, fn func(*syncer) error) {
+	if r.Method != "POST" {
+		writeControlError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	syncers, err := c.lookup(r.URL.Query().Get("watch"))
+	if err != nil {
+		writeControlError(w, http.StatusNotFound, err)
+		return
+	}
+	results := make(map[string]string, len(syncers))
+	status := http.StatusOK
+	for _, s := range syncers {
+		if err := fn(s); err != nil {
+			results[s.cfg.Dir] = err.Error()
+			status = http.StatusConflict
+			continue
+		}
+		results[s.cfg.Dir] = done
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+func writeControlResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeControlError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// ctlUsage prints the usage of the ctl sub-command and exits with status 1.
+func ctlUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "usage: %s ctl [flags] status|pause|resume|resync\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+		exit(1)
+	}
+}
+
+// runCtl implements the ctl sub-command, a client of the control API.
+func runCtl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	fs.Usage = ctlUsage(fs)
+	cfgPath := fs.String("config", "config.toml", "path to configuration file")
+	addr := fs.String("addr", "", "address of the control API (default: read from the configuration file)")
+	watch := fs.String("watch", "", "directory of the watch to act on (default: all)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return
+	}
+	cmd := fs.Arg(0)
+	var method string
+	switch cmd {
+	case "status":
+		method = "GET"
+	case "pause", "resume", "resync":
+		method = "POST"
+	default:
+		fs.Usage()
+		return
+	}
+
+	if *addr == "" {
+		cfg, err := readConfig(*cfgPath)
+		if err != nil {
+			fatal(err)
+			return
+		}
+		*addr = cfg.Control.Listen
+	}
+	if *addr == "" {
+		fatal("control api is not enabled")
+		return
+	}
+
+	if err := ctlRequest(stdout, *addr, method, cmd, *watch); err != nil {
+		fatal(err)
+	}
+}
+
+// ctlRequest sends a request to the control API listening on addr and copies
+// the response to w.
+func ctlRequest(w io.Writer, addr, method, cmd, watch string) error {
+	network, address := listenAddr(addr)
+	client := &http.Client{
+		Timeout: 5 * time.Minute,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, address)
+			},
+		},
+	}
+	u := "http://f5-auto-uploader/v1/" + cmd
+	if watch != "" {
+		u += "?watch=" + url.QueryEscape(watch)
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach control api: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("cannot read response from control api: %v", err)
+	}
+	if cmd == "status" && resp.StatusCode == http.StatusOK {
+		return printStatus(w, body)
+	}
+	w.Write(body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed: %s", cmd, resp.Status)
+	}
+	return nil
+}
+
+// printStatus prints the status returned by the control API in a human
+// readable form.
+func printStatus(w io.Writer, body []byte) error {
+	var watches []controlWatchStatus
+	if err := json.Unmarshal(body, &watches); err != nil {
+		return fmt.Errorf("cannot decode status: %v", err)
+	}
+	for _, ws := range watches {
+		state := "running"
+		if ws.Paused {
+			state = fmt.Sprintf("paused (%d held events)", ws.Held)
+		}
+		fmt.Fprintf(w, "%s: %s, %d pending retries\n", ws.Directory, state, ws.RetryQueue)
+		paths := make([]string, 0, len(ws.Files))
+		for path := range ws.Files {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			fs := ws.Files[path]
+			result := "ok"
+			if fs.Error != "" {
+				result = "error: " + fs.Error
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\n",
+				fs.Time.Format(time.RFC3339), fs.Action, path, fs.Checksum, result)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	fsnotify "gopkg.in/fsnotify.v1"
+)
+
+func newTestSyncer(dir string) *syncer {
+	env := syncEnv{target: "https://bigip", l: discardLogger{}}
+	s, err := newSyncer(env, watchConfig{Dir: dir})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func TestController(t *testing.T) {
+	ctl := &controller{}
+	s := newTestSyncer("/tmp/test")
+	ctl.add(s)
+	ts := httptest.NewServer(ctl.handler())
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/v1/pause?watch=/tmp/test", "", nil)
+	if err != nil {
+		t.Fatalf("POST /v1/pause: unexpected error %q", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /v1/pause: got status %d; want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// Events received while paused are held and not applied.
+	s.syncEvents([]watchEvent{{Name: "/tmp/test/index.html", Op: fsnotify.Write}})
+
+	resp, err = http.Get(ts.URL + "/v1/status")
+	if err != nil {
+		t.Fatalf("GET /v1/status: unexpected error %q", err.Error())
+	}
+	var status []controlWatchStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("GET /v1/status: cannot decode body: %v", err)
+	}
+	if len(status) != 1 {
+		t.Fatalf("GET /v1/status: got %d watches; want %d", len(status), 1)
+	}
+	if !status[0].Paused || status[0].Held != 1 {
+		t.Errorf("GET /v1/status: got paused=%v held=%d; want paused=true held=1",
+			status[0].Paused, status[0].Held)
+	}
+
+	resp, err = http.Post(ts.URL+"/v1/resync?watch=/tmp/test", "", nil)
+	if err != nil {
+		t.Fatalf("POST /v1/resync: unexpected error %q", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("POST /v1/resync while paused: got status %d; want %d", resp.StatusCode, http.StatusConflict)
+	}
+
+	resp, err = http.Get(ts.URL + "/v1/status?watch=/unknown")
+	if err != nil {
+		t.Fatalf("GET /v1/status: unexpected error %q", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /v1/status?watch=/unknown: got status %d; want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestPrintStatus(t *testing.T) {
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	body, _ := json.Marshal([]controlWatchStatus{{
+		Directory: "/tmp/test",
+		Files: map[string]fileStatus{
+			"/tmp/test/index.html": {Action: "update", Checksum: "SHA1:4:abc", Time: now},
+		},
+	}})
+	buf := new(bytes.Buffer)
+	if err := printStatus(buf, body); err != nil {
+		t.Fatalf("printStatus(): unexpected error %q", err.Error())
+	}
+	want := "/tmp/test: running, 0 pending retries\n" +
+		"  2017-06-01T12:00:00Z\tupdate\t/tmp/test/index.html\tSHA1:4:abc\tok\n"
+	if got := buf.String(); got != want {
+		t.Errorf("printStatus(): got %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ignoreFileName is the name of the file, at the root of a watched directory,
+// listing patterns of files to ignore with the semantics of .gitignore.
+const ignoreFileName = ".f5ignore"
+
+// matchRule is a compiled gitignore-style pattern.
+type matchRule struct {
+	pattern  string // as written
+	negate   bool   // "!pattern", re-includes what previous rules excluded
+	dirOnly  bool   // "pattern/", only matches directories
+	anchored bool   // matched against the relative path rather than the name
+	nested   bool   // only matches the content of sub-directories
+	re       *regexp.Regexp
+}
+
+// compileRule compiles a gitignore-style pattern. It returns nil for blank
+// lines and comments.
+func compileRule(pattern string) (*matchRule, error) {
+	r := &matchRule{pattern: pattern}
+	p := strings.TrimRight(pattern, " \t\r")
+	if p == "" || strings.HasPrefix(p, "#") {
+		return nil, nil
+	}
+	if strings.HasPrefix(p, "!") {
+		r.negate = true
+		p = p[1:]
+	} else if strings.HasPrefix(p, `\!`) || strings.HasPrefix(p, `\#`) {
+		p = p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if p == "" {
+		return nil, fmt.Errorf("invalid pattern %q", pattern)
+	}
+	if strings.Contains(p, "/") {
+		r.anchored = true
+		p = strings.TrimPrefix(p, "/")
+		// Leading "**/" also match zero directories, e.g. "**/*.html"
+		// matches "index.html".
+		rest := p
+		for strings.HasPrefix(rest, "**/") {
+			rest = rest[len("**/"):]
+		}
+		r.nested = strings.Contains(rest, "/")
+	}
+	expr, err := globToRegexp(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	if r.re, err = regexp.Compile("^" + expr + "$"); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return r, nil
+}
+
+// globToRegexp translates a glob pattern, matched against slash separated
+// paths, into a regular expression. "*" and "?" do not match slashes while
+// "**" matches any number of directories.
+func globToRegexp(glob string) (string, error) {
+	var buf []byte
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				atStart := i == 0 || glob[i-1] == '/'
+				i++
+				switch {
+				case atStart && i+1 < len(glob) && glob[i+1] == '/':
+					// "**/" matches zero or more directories.
+					i++
+					buf = append(buf, "(?:.*/)?"...)
+				default:
+					buf = append(buf, ".*"...)
+				}
+				continue
+			}
+			buf = append(buf, "[^/]*"...)
+		case '?':
+			buf = append(buf, "[^/]"...)
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == 0 && i+2 < len(glob) {
+				// A leading "]" is part of the class.
+				if next := strings.IndexByte(glob[i+2:], ']'); next >= 0 {
+					end = next + 1
+				} else {
+					end = -1
+				}
+			}
+			if end < 0 {
+				return "", errors.New("unterminated character class")
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf = append(buf, '[')
+			buf = append(buf, strings.Replace(class, `\`, `\\`, -1)...)
+			buf = append(buf, ']')
+			i += end + 1
+		case '\\':
+			if i+1 == len(glob) {
+				return "", errors.New("trailing backslash")
+			}
+			i++
+			buf = append(buf, regexp.QuoteMeta(glob[i:i+1])...)
+		default:
+			buf = append(buf, regexp.QuoteMeta(string(c))...)
+		}
+	}
+	return string(buf), nil
+}
+
+// matches reports whether the rule matches the file or directory located at
+// rel, relative to the root of the watched directory.
+func (r *matchRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.anchored {
+		return r.re.MatchString(rel)
+	}
+	return r.re.MatchString(path.Base(rel))
+}
+
+// checkFlat makes sure that the rule may match files located at the root of
+// the watched directory. The sub-directories of the watches of iFiles are not
+// synchronised, hence the rules that only match directories or their content
+// would have no effect.
+func (r *matchRule) checkFlat() error {
+	if r.dirOnly {
+		return fmt.Errorf("pattern %q only matches directories, which are not synchronised", r.pattern)
+	}
+	if r.nested {
+		return fmt.Errorf("pattern %q matches files of sub-directories, which are not synchronised", r.pattern)
+	}
+	return nil
+}
+
+func compileRules(patterns []string, flat bool) ([]*matchRule, error) {
+	var rules []*matchRule
+	for _, p := range patterns {
+		r, err := compileRule(p)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			continue
+		}
+		if flat {
+			if err := r.checkFlat(); err != nil {
+				return nil, err
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// lastMatch returns the last rule matching rel, if any.
+func lastMatch(rules []*matchRule, rel string, isDir bool) *matchRule {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].matches(rel, isDir) {
+			return rules[i]
+		}
+	}
+	return nil
+}
+
+// fileFilter decides which files of a watched directory are synchronised. A
+// file is skipped when it is excluded, by the exclusion patterns of the
+// configuration or by the ones read from the .f5ignore file, or, when include
+// patterns are given, when it does not match any of them. As with .gitignore,
+// the last matching pattern wins and the files of an excluded directory can
+// not be included again.
+type fileFilter struct {
+	root    string
+	flat    bool // whether the sub-directories are ignored
+	l       logger
+	include []*matchRule
+	config  []*matchRule // exclusion patterns of the configuration
+
+	mu      sync.Mutex
+	exclude []*matchRule // config followed by the rules of the .f5ignore file
+}
+
+// newFileFilter returns the filter of the directory root. When flat is true,
+// the sub-directories are not synchronised and the patterns that would only
+// match them are rejected.
+func newFileFilter(root string, flat bool, include, exclude []string, l logger) (*fileFilter, error) {
+	f := &fileFilter{root: root, flat: flat, l: l}
+	var err error
+	if f.include, err = compileRules(include, flat); err != nil {
+		return nil, err
+	}
+	if f.config, err = compileRules(exclude, flat); err != nil {
+		return nil, err
+	}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload reads the .f5ignore file again. The current rules are kept if the
+// file is invalid. The rules having no effect on a flat directory are ignored
+// with a warning.
+func (f *fileFilter) reload() error {
+	rules := append([]*matchRule(nil), f.config...)
+	ignorePath := filepath.Join(f.root, ignoreFileName)
+	file, err := os.Open(ignorePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot open %q: %v", ignorePath, err)
+	}
+	if err == nil {
+		defer file.Close()
+		sc := bufio.NewScanner(file)
+		for n := 1; sc.Scan(); n++ {
+			r, err := compileRule(sc.Text())
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", ignorePath, n, err)
+			}
+			if r == nil {
+				continue
+			}
+			if f.flat {
+				if err := r.checkFlat(); err != nil {
+					f.l.Warnf("%s:%d: ignoring rule: %v", ignorePath, n, err)
+					continue
+				}
+			}
+			rules = append(rules, r)
+		}
+		if err := sc.Err(); err != nil {
+			return fmt.Errorf("cannot read %q: %v", ignorePath, err)
+		}
+	}
+	f.mu.Lock()
+	f.exclude = rules
+	f.mu.Unlock()
+	return nil
+}
+
+// isIgnoreFile reports whether p is the .f5ignore file of the filter.
+func (f *fileFilter) isIgnoreFile(p string) bool {
+	return f != nil && filepath.Clean(p) == filepath.Join(f.root, ignoreFileName)
+}
+
+// skip reports whether the file, or directory, located at p must not be
+// synchronised. A nil filter does not skip anything.
+func (f *fileFilter) skip(p string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+	rel, err := filepath.Rel(f.root, p)
+	if err != nil || rel == "." {
+		return false
+	}
+	if f.isIgnoreFile(p) {
+		return true
+	}
+	rel = filepath.ToSlash(rel)
+
+	f.mu.Lock()
+	exclude := f.exclude
+	f.mu.Unlock()
+
+	// The files of an excluded directory are excluded as well.
+	parts := strings.Split(rel, "/")
+	for i := 1; i <= len(parts); i++ {
+		sub := strings.Join(parts[:i], "/")
+		subIsDir := isDir || i < len(parts)
+		if r := lastMatch(exclude, sub, subIsDir); r != nil && !r.negate {
+			f.l.Debugf("%q is excluded by pattern %q", p, r.pattern)
+			return true
+		}
+	}
+	if isDir || len(f.include) == 0 {
+		return false
+	}
+	if r := lastMatch(f.include, rel, false); r == nil || r.negate {
+		f.l.Debugf("%q does not match any inclusion pattern", p)
+		return true
+	}
+	return false
+}
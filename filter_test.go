@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompileRule(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		isDir   bool
+		want    bool
+	}{
+		{"*.tmp", "a.tmp", false, true},
+		{"*.tmp", "sub/dir/a.tmp", false, true},
+		{"*.tmp", "a.tmpl", false, false},
+		{"/*.tmp", "a.tmp", false, true},
+		{"/*.tmp", "sub/a.tmp", false, false},
+		{"sub/*.html", "sub/index.html", false, true},
+		{"sub/*.html", "sub/dir/index.html", false, false},
+		{"sub/**/*.html", "sub/index.html", false, true},
+		{"sub/**/*.html", "sub/a/b/index.html", false, true},
+		{"**/build", "a/b/build", true, true},
+		{"**/build", "build", false, true},
+		{"logs/**", "logs/a/b.log", false, true},
+		{"logs/", "logs", true, true},
+		{"logs/", "logs", false, false},
+		{"file?.txt", "file1.txt", false, true},
+		{"file[0-9].txt", "filea.txt", false, false},
+		{"file[!0-9].txt", "filea.txt", false, true},
+		{`\#notes`, "#notes", false, true},
+	}
+	for _, test := range tests {
+		r, err := compileRule(test.pattern)
+		if err != nil {
+			t.Errorf("compileRule(%q): unexpected error %q", test.pattern, err.Error())
+			continue
+		}
+		if got := r.matches(test.rel, test.isDir); got != test.want {
+			t.Errorf("compileRule(%q).matches(%q, %v): got %v; want %v",
+				test.pattern, test.rel, test.isDir, got, test.want)
+		}
+	}
+
+	for _, pattern := range []string{"", "# comment", "   "} {
+		if r, err := compileRule(pattern); r != nil || err != nil {
+			t.Errorf("compileRule(%q): got (%v, %v); want (nil, nil)", pattern, r, err)
+		}
+	}
+	for _, pattern := range []string{"[a-", "!", `foo\`} {
+		if _, err := compileRule(pattern); err == nil {
+			t.Errorf("compileRule(%q): expected error, got nil", pattern)
+		}
+	}
+}
+
+func TestFileFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+	ignore := "# generated files\nbuild/\n*.tmp\n!keep.tmp\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, ignoreFileName), []byte(ignore), 0644); err != nil {
+		t.Fatal("setup: ", err)
+	}
+
+	f, err := newFileFilter(dir, false, []string{"*.html", "*.json", "*.tmp"}, []string{".*", "vendor/"}, discardLogger{})
+	if err != nil {
+		t.Fatalf("newFileFilter: unexpected error %q", err.Error())
+	}
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"index.html", false, false},
+		{"data/app.json", false, false},
+		{"app.js", false, true},
+		{".index.html", false, true},
+		{ignoreFileName, false, true},
+		{"build", true, true},
+		{"build/index.html", false, true},
+		{"vendor/lib/index.html", false, true},
+		{"data", true, false},
+		{"a.tmp", false, true},
+		{"keep.tmp", false, false},
+		{"data/keep.tmp", false, false},
+	}
+	for _, test := range tests {
+		p := filepath.Join(dir, filepath.FromSlash(test.rel))
+		if got := f.skip(p, test.isDir); got != test.want {
+			t.Errorf("skip(%q, %v): got %v; want %v", test.rel, test.isDir, got, test.want)
+		}
+	}
+
+	for _, pattern := range []string{"**/*.tmp", "/**/*.tmp", "**/**/*.tmp"} {
+		f, err := newFileFilter(dir, true, nil, []string{pattern}, discardLogger{})
+		if err != nil {
+			t.Errorf("newFileFilter(flat, %q): unexpected error %q", pattern, err.Error())
+			continue
+		}
+		if !f.skip(filepath.Join(dir, "a.tmp"), false) {
+			t.Errorf("newFileFilter(flat, %q): skip(%q): got false; want true", pattern, "a.tmp")
+		}
+	}
+
+	// The rules of the .f5ignore file are replaced on reload while the ones
+	// of the configuration are kept.
+	if err := ioutil.WriteFile(filepath.Join(dir, ignoreFileName), []byte("index.html\n"), 0644); err != nil {
+		t.Fatal("setup: ", err)
+	}
+	if err := f.reload(); err != nil {
+		t.Fatalf("reload: unexpected error %q", err.Error())
+	}
+	for rel, want := range map[string]bool{"index.html": true, "a.tmp": false, ".a.tmp": true} {
+		if got := f.skip(filepath.Join(dir, rel), false); got != want {
+			t.Errorf("skip(%q) after reload: got %v; want %v", rel, got, want)
+		}
+	}
+
+	// Invalid rules are reported along with their line and the previous
+	// ones are kept.
+	if err := ioutil.WriteFile(filepath.Join(dir, ignoreFileName), []byte("*.tmp\n[a-\n"), 0644); err != nil {
+		t.Fatal("setup: ", err)
+	}
+	if err := f.reload(); err == nil {
+		t.Error("reload: expected error, got nil")
+	}
+	if !f.skip(filepath.Join(dir, "index.html"), false) {
+		t.Error("skip(\"index.html\") after failed reload: got false; want true")
+	}
+
+	var nilFilter *fileFilter
+	if nilFilter.skip(filepath.Join(dir, "index.html"), false) {
+		t.Error("nil filter: skip(\"index.html\"): got true; want false")
+	}
+}
+
+func TestFileFilter_Flat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, pattern := range []string{"build/", "!keep/", "dir/*.html", "**/dir/*.tmp", "/dir/**"} {
+		if _, err := newFileFilter(dir, true, nil, []string{pattern}, discardLogger{}); err == nil {
+			t.Errorf("newFileFilter(flat, %q): expected error, got nil", pattern)
+		}
+		if _, err := newFileFilter(dir, false, nil, []string{pattern}, discardLogger{}); err != nil {
+			t.Errorf("newFileFilter(%q): unexpected error %q", pattern, err.Error())
+		}
+	}
+
+	// The rules of the .f5ignore file that have no effect are ignored.
+	ignore := "build/\n*.tmp\n/index.html\ndir/*.html\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, ignoreFileName), []byte(ignore), 0644); err != nil {
+		t.Fatal("setup: ", err)
+	}
+	f, err := newFileFilter(dir, true, []string{"*.html", "*.tmp"}, []string{"/app.html"}, discardLogger{})
+	if err != nil {
+		t.Fatalf("newFileFilter(flat): unexpected error %q", err.Error())
+	}
+	if len(f.exclude) != 3 {
+		t.Errorf("newFileFilter(flat): got %d exclusion rules; want 3", len(f.exclude))
+	}
+	for rel, want := range map[string]bool{"index.html": true, "app.html": true, "a.tmp": true, "about.html": false} {
+		if got := f.skip(filepath.Join(dir, rel), false); got != want {
+			t.Errorf("skip(%q): got %v; want %v", rel, got, want)
+		}
+	}
+}
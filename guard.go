@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Reasons for which a file is refused by the guardrails, as used in the
+// metrics.
+const (
+	guardEmpty     = "empty"
+	guardSize      = "size"
+	guardExtension = "extension"
+	guardType      = "type"
+	guardBinary    = "binary"   // NUL bytes
+	guardEncoding  = "encoding" // invalid UTF-8
+)
+
+// guardError reports a file refused by the guardrails of a watch.
+type guardError struct {
+	reason string
+	msg    string
+}
+
+func (e *guardError) Error() string {
+	return e.msg
+}
+
+func guardErrorf(reason, format string, v ...interface{}) error {
+	return &guardError{reason: reason, msg: fmt.Sprintf(format, v...)}
+}
+
+// guard holds the restrictions on the files uploaded by a watch.
+type guard struct {
+	maxSize    int64 // in bytes, no limit when 0
+	extensions map[string]struct{}
+	types      []string // media type patterns, e.g. "text/*"
+	textOnly   bool
+}
+
+func newGuard(cfg watchConfig) *guard {
+	g := &guard{
+		maxSize:  cfg.MaxSizeKB * 1024,
+		types:    cfg.AllowedTypes,
+		textOnly: cfg.TextOnly,
+	}
+	if len(cfg.AllowedExtensions) > 0 {
+		g.extensions = make(map[string]struct{}, len(cfg.AllowedExtensions))
+		for _, ext := range cfg.AllowedExtensions {
+			g.extensions[normalizeExtension(ext)] = struct{}{}
+		}
+	}
+	return g
+}
+
+// normalizeExtension returns ext in lower case with a leading dot.
+func normalizeExtension(ext string) string {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// check returns a *guardError when the file located at path must not be
+// uploaded. Empty files are always refused.
+func (g *guard) check(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("cannot stat %q: %v", path, err)
+	}
+	if fi.Size() == 0 {
+		return guardErrorf(guardEmpty, "%q is empty", path)
+	}
+	if g.maxSize > 0 && fi.Size() > g.maxSize {
+		return guardErrorf(guardSize, "%q is %d bytes long, more than the %d bytes allowed", path, fi.Size(), g.maxSize)
+	}
+	if g.extensions != nil {
+		ext := strings.ToLower(filepath.Ext(path))
+		if _, ok := g.extensions[ext]; !ok {
+			return guardErrorf(guardExtension, "extension of %q is not allowed", path)
+		}
+	}
+	if len(g.types) == 0 && !g.textOnly {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %v", path, err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if len(g.types) > 0 {
+		head, err := r.Peek(512)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return fmt.Errorf("cannot read %q: %v", path, err)
+		}
+		typ := mediaType(path, head)
+		if !g.allowedType(typ) {
+			return guardErrorf(guardType, "type %q of %q is not allowed", typ, path)
+		}
+	}
+	if g.textOnly {
+		return checkText(path, r)
+	}
+	return nil
+}
+
+// mediaType returns the media type of the file located at path, guessed from
+// its extension or, failing that, from the first bytes of its content.
+func mediaType(path string, head []byte) string {
+	typ := mime.TypeByExtension(filepath.Ext(path))
+	if typ == "" {
+		typ = http.DetectContentType(head)
+	}
+	if mt, _, err := mime.ParseMediaType(typ); err == nil {
+		return mt
+	}
+	return typ
+}
+
+func (g *guard) allowedType(typ string) bool {
+	for _, pattern := range g.types {
+		if ok, _ := path.Match(strings.ToLower(pattern), typ); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkText makes sure that the content read from r is valid UTF-8 text
+// without NUL bytes.
+func checkText(path string, r *bufio.Reader) error {
+	for offset := 0; ; {
+		c, size, err := r.ReadRune()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read %q: %v", path, err)
+		}
+		switch {
+		case c == 0:
+			return guardErrorf(guardBinary, "%q contains a NUL byte at offset %d", path, offset)
+		case c == utf8.RuneError && size == 1:
+			return guardErrorf(guardEncoding, "%q contains invalid UTF-8 at offset %d", path, offset)
+		}
+		offset += size
+	}
+}
+
+// checkGuard checks the file located at path against the guardrails of the
+// watch. Refused files are logged and counted in the metrics.
+func (s *syncer) checkGuard(path string) error {
+	err := s.guard.check(path)
+	if ge, ok := err.(*guardError); ok {
+		s.l.With(fields{"file": path, "reason": ge.reason}).Warnf("refusing to upload %q: %v", path, err)
+		stats.observeGuardViolation(s.cfg.Dir, ge.reason)
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGuardCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		"empty.html":  nil,
+		"index.html":  []byte("<html><body>héllo</body></html>"),
+		"data.json":   []byte(`{"a": 1}`),
+		"big.html":    bytes.Repeat([]byte("a"), 2048),
+		"nul.html":    []byte("<html>\x00</html>"),
+		"latin1.html": []byte("<html>h\xe9llo</html>"),
+		"image.png":   []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"),
+		"noext":       []byte("plain text"),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal("setup: ", err)
+		}
+	}
+
+	tests := []struct {
+		cfg    watchConfig
+		name   string
+		reason string // empty when accepted
+	}{
+		{watchConfig{}, "index.html", ""},
+		{watchConfig{}, "empty.html", guardEmpty},
+		{watchConfig{}, "image.png", ""},
+		{watchConfig{MaxSizeKB: 1}, "index.html", ""},
+		{watchConfig{MaxSizeKB: 1}, "big.html", guardSize},
+		{watchConfig{AllowedExtensions: []string{".html", "JSON"}}, "data.json", ""},
+		{watchConfig{AllowedExtensions: []string{".html", "JSON"}}, "image.png", guardExtension},
+		{watchConfig{AllowedExtensions: []string{".html"}}, "noext", guardExtension},
+		{watchConfig{AllowedTypes: []string{"text/*", "application/json"}}, "data.json", ""},
+		{watchConfig{AllowedTypes: []string{"text/*", "application/json"}}, "noext", ""},
+		{watchConfig{AllowedTypes: []string{"text/*"}}, "image.png", guardType},
+		{watchConfig{TextOnly: true}, "index.html", ""},
+		{watchConfig{TextOnly: true}, "nul.html", guardBinary},
+		{watchConfig{TextOnly: true}, "latin1.html", guardEncoding},
+		{watchConfig{TextOnly: true}, "image.png", guardEncoding},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		err := newGuard(test.cfg).check(path)
+		var reason string
+		if ge, ok := err.(*guardError); ok {
+			reason = ge.reason
+		} else if err != nil {
+			t.Errorf("check(%q) with %+v: unexpected error %q", test.name, test.cfg, err.Error())
+			continue
+		}
+		if reason != test.reason {
+			t.Errorf("check(%q) with %+v: got reason %q; want %q", test.name, test.cfg, reason, test.reason)
+		}
+	}
+}
+
+func TestSyncerCheckGuard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte("log line\n"), 1024), 0644); err != nil {
+		t.Fatal("setup: ", err)
+	}
+
+	env := syncEnv{target: "https://bigip", l: discardLogger{}}
+	s, err := newSyncer(env, watchConfig{Dir: dir, MaxSizeKB: 4})
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	if err := s.checkGuard(path); err == nil {
+		t.Fatalf("checkGuard(%q): expected error, got nil", path)
+	}
+
+	var buf bytes.Buffer
+	stats.writeTo(&buf)
+	want := `f5_auto_uploader_guard_violations_total{watch="` + dir + `",reason="size"} 1`
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("metrics do not contain %q:\n%s", want, buf.String())
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/e-XpertSolutions/f5-rest-client/f5"
+)
+
+// defaultHandlerName is the name of the handler used by watches that do not
+// specify any type.
+const defaultHandlerName = "ifile"
+
+// objectNameRegexp restricts the names of the objects created on the BigIP to
+// characters that are safe to use in REST paths and shell commands.
+var objectNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// handler manages one type of BigIP object whose content comes from a local
+// file. Objects are identified by the base name of the file.
+type handler interface {
+	// List returns the names of the objects that exist on the BigIP.
+	List(c *f5.Client) (map[string]struct{}, error)
+
+	// Checksum returns the checksum of the named object as reported by the
+	// BigIP, i.e. "<algo>:<checksum>".
+	Checksum(c *f5.Client, name string) (string, error)
+
+	// Checksums returns the checksums of all the objects, indexed by name,
+	// in as few requests as possible.
+	Checksums(c *f5.Client) (map[string]string, error)
+
+	// Create, Update and Delete are meant to be called within a transaction.
+	Create(tx *f5.Client, name string, src *source) error
+	Update(tx *f5.Client, name string, src *source) error
+	Delete(tx *f5.Client, name string) error
+
+	// Validate checks whether the local file can be uploaded under name.
+	Validate(name, path string) error
+
+	// References returns the full path of the objects that still make use of
+	// the named object, such as iRules.
+	References(c *f5.Client, name string) ([]string, error)
+}
+
+// handlers lists the supported object types.
+var handlers = map[string]handler{
+	"ifile": ifileHandler{},
+}
+
+// lookupHandler returns the handler registered under name, or the default one
+// when name is empty.
+func lookupHandler(name string) (handler, error) {
+	if name == "" {
+		name = defaultHandlerName
+	}
+	h, ok := handlers[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported object type %q (supported: %v)", name, handlerNames())
+	}
+	return h, nil
+}
+
+func handlerNames() []string {
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkDelete makes sure that the named object can safely be deleted, that is
+// no other object on the BigIP still references it. Referenced objects are
+// only deleted when force is true.
+func checkDelete(c *f5.Client, l logger, h handler, name string, force bool) error {
+	refs, err := h.References(c, name)
+	if err != nil {
+		return fmt.Errorf("cannot check references to %q: %v", name, err)
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	if !force {
+		return fmt.Errorf("refusing to delete %q since it is still referenced by %s (set force_delete to delete it anyway)",
+			name, strings.Join(refs, ", "))
+	}
+	l.Noticef("deleting %q although it is still referenced by %s", name, strings.Join(refs, ", "))
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/e-XpertSolutions/f5-rest-client/f5"
+)
+
+func TestLookupHandler(t *testing.T) {
+	h, err := lookupHandler("")
+	if err != nil {
+		t.Fatalf("lookupHandler(%q): unexpected error %q", "", err.Error())
+	}
+	if _, ok := h.(ifileHandler); !ok {
+		t.Errorf("lookupHandler(%q): got %T; want %T", "", h, ifileHandler{})
+	}
+
+	if _, err := lookupHandler("ifile"); err != nil {
+		t.Errorf("lookupHandler(%q): unexpected error %q", "ifile", err.Error())
+	}
+
+	_, err = lookupHandler("unknown")
+	if err == nil {
+		t.Fatalf("lookupHandler(%q): expected error, got nil", "unknown")
+	}
+	wantErr := `unsupported object type "unknown" (supported: [ifile])`
+	if got := err.Error(); got != wantErr {
+		t.Errorf("lookupHandler(%q): got error %q; want %q", "unknown", got, wantErr)
+	}
+}
+
+func TestIFileHandler_Validate(t *testing.T) {
+	var h ifileHandler
+	if err := h.Validate("index.html", "/tmp/index.html"); err != nil {
+		t.Errorf("ifileHandler.Validate(%q): unexpected error %q", "index.html", err.Error())
+	}
+	if err := h.Validate("my file.html", "/tmp/my file.html"); err == nil {
+		t.Errorf("ifileHandler.Validate(%q): expected error, got nil", "my file.html")
+	}
+}
+
+func TestIFileReferenceRegexp(t *testing.T) {
+	tests := []struct {
+		rule string
+		want bool
+	}{
+		{`HTTP::respond 200 content [ifile get index.html]`, true},
+		{`HTTP::respond 200 content [ifile get /Common/index.html]`, true},
+		{`set data [ifile get "index.html"]`, true},
+		{`set data [ifile get {index.html}]`, true},
+		{`set sum [ifile checksum index.html]`, true},
+		{`HTTP::respond 200 content [ifile get index.html.bak]`, false},
+		{`HTTP::respond 200 content [ifile get old_index.html]`, false},
+		{`HTTP::respond 200 content [ifile get indexxhtml]`, false},
+		{`# index.html`, false},
+	}
+	re := ifileReferenceRegexp("index.html")
+	for _, test := range tests {
+		if got := re.MatchString(test.rule); got != test.want {
+			t.Errorf("ifileReferenceRegexp(%q).MatchString(%q): got %v; want %v",
+				"index.html", test.rule, got, test.want)
+		}
+	}
+}
+
+func TestIFileHandler_Checksums(t *testing.T) {
+	// The last items are iFiles of another partition sharing their names
+	// with the first ones.
+	const total, other = 600, 10
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		q := r.URL.Query()
+		if r.URL.Path != sysIFilePath || q.Get("$select") != "name,fullPath,checksum" {
+			http.NotFound(w, r)
+			return
+		}
+		top, _ := strconv.Atoi(q.Get("$top"))
+		skip, _ := strconv.Atoi(q.Get("$skip"))
+		type item struct {
+			Name     string `json:"name"`
+			FullPath string `json:"fullPath"`
+			Checksum string `json:"checksum"`
+		}
+		var page struct {
+			Items    []item `json:"items"`
+			NextLink string `json:"nextLink,omitempty"`
+		}
+		for i := skip; i < total && i < skip+top; i++ {
+			if i >= total-other {
+				name := fmt.Sprintf("file%d.html", i-total+other)
+				page.Items = append(page.Items, item{name, "/Tenant/" + name, "SHA1:0:"})
+				continue
+			}
+			name := fmt.Sprintf("file%d.html", i)
+			page.Items = append(page.Items, item{name, "/Common/" + name, fmt.Sprintf("SHA1:%d:%040d", i, i)})
+		}
+		if skip+top < total {
+			page.NextLink = fmt.Sprintf("https://localhost%s?$skip=%d", sysIFilePath, skip+top)
+		}
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer ts.Close()
+	c, err := f5.NewBasicClient(ts.URL, "admin", "admin")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+
+	var h ifileHandler
+	checksums, err := h.Checksums(c)
+	if err != nil {
+		t.Fatalf("ifileHandler.Checksums: unexpected error %q", err.Error())
+	}
+	if len(checksums) != total-other {
+		t.Errorf("ifileHandler.Checksums: got %d checksums; want %d", len(checksums), total-other)
+	}
+	if got, want := checksums["file5.html"], fmt.Sprintf("SHA1:%d:%040d", 5, 5); got != want {
+		t.Errorf("ifileHandler.Checksums: got checksum %q for file5.html; want %q of the Common partition", got, want)
+	}
+	if got, want := checksums["file512.html"], fmt.Sprintf("SHA1:512:%040d", 512); got != want {
+		t.Errorf("ifileHandler.Checksums: got checksum %q for file512.html; want %q", got, want)
+	}
+	if want := (total + ifileChecksumsPageSize - 1) / ifileChecksumsPageSize; requests != want {
+		t.Errorf("ifileHandler.Checksums: got %d requests; want %d", requests, want)
+	}
+}
+
+func TestIFileHandler_Checksums_IgnoredSkip(t *testing.T) {
+	// The BigIP ignores $skip and always answers with the first page.
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests > 10 {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprintf(w, `{"items":[{"name":"a.html","fullPath":"/Common/a.html","checksum":"SHA1:1:%040d"}],"nextLink":"https://localhost%s?$skip=1"}`, 1, sysIFilePath)
+	}))
+	defer ts.Close()
+	c, err := f5.NewBasicClient(ts.URL, "admin", "admin")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+
+	var h ifileHandler
+	checksums, err := h.Checksums(c)
+	if err != nil {
+		t.Fatalf("ifileHandler.Checksums: unexpected error %q", err.Error())
+	}
+	if len(checksums) != 1 {
+		t.Errorf("ifileHandler.Checksums: got %d checksums; want 1", len(checksums))
+	}
+	if requests != 2 {
+		t.Errorf("ifileHandler.Checksums: got %d requests; want 2", requests)
+	}
+}
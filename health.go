@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// defaultMaxRetryQueue is the default number of pending retries above which
+// the service is not considered ready anymore.
+const defaultMaxRetryQueue = 100
+
+// routineHealth tracks the state of a watch routine for the health reports.
+type routineHealth struct {
+	kind    string // "watch" or "ilx"
+	dir     string
+	retries *retryQueue // may be nil
+	scanned bool
+	routine *watchRoutine
+}
+
+// routineReport is the JSON representation of a routineHealth.
+type routineReport struct {
+	Kind       string `json:"kind"`
+	Directory  string `json:"directory"`
+	Alive      bool   `json:"alive"`
+	Scanned    bool   `json:"scanned"`
+	RetryQueue int    `json:"retry_queue"`
+}
+
+type healthReport struct {
+	Status      string          `json:"status"`
+	Target      string          `json:"target"`
+	Reachable   bool            `json:"reachable"`
+	InitialScan bool            `json:"initial_scan_completed"`
+	Routines    []routineReport `json:"routines"`
+}
+
+// health tracks whether the service is healthy, i.e. all of its watch routines
+// are running, and ready, i.e. the initial synchronisation is over, the BigIP
+// is reachable and not too many changes are waiting to be retried.
+type health struct {
+	mu            sync.Mutex
+	target        string
+	maxRetryQueue int
+	started       bool
+	routines      []*routineHealth
+}
+
+// healthState holds the health of the running process.
+var healthState = &health{maxRetryQueue: defaultMaxRetryQueue}
+
+// setTarget sets the BigIP whose reachability is reported.
+func (h *health) setTarget(target string) {
+	h.mu.Lock()
+	h.target = target
+	h.mu.Unlock()
+}
+
+// register starts tracking the routine of the given kind watching dir.
+func (h *health) register(kind, dir string, retries *retryQueue) *routineHealth {
+	rh := &routineHealth{kind: kind, dir: dir, retries: retries}
+	h.mu.Lock()
+	h.routines = append(h.routines, rh)
+	h.mu.Unlock()
+	return rh
+}
+
+// unregister stops tracking the routine.
+func (h *health) unregister(rh *routineHealth) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, r := range h.routines {
+		if r == rh {
+			h.routines = append(h.routines[:i], h.routines[i+1:]...)
+			return
+		}
+	}
+}
+
+// setScanned records that the initial scan of the routine is over.
+func (h *health) setScanned(rh *routineHealth) {
+	h.mu.Lock()
+	rh.scanned = true
+	h.mu.Unlock()
+}
+
+// setRoutine records the watch routine once started.
+func (h *health) setRoutine(rh *routineHealth, wr *watchRoutine) {
+	h.mu.Lock()
+	rh.routine = wr
+	h.mu.Unlock()
+}
+
+// setStarted records that all the watch routines have been started.
+func (h *health) setStarted() {
+	h.mu.Lock()
+	h.started = true
+	h.mu.Unlock()
+}
+
+// report computes the current health of the service and tells whether it is
+// healthy and ready.
+func (h *health) report() (r healthReport, healthy, ready bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r.Target = h.target
+	r.Reachable = stats.isReachable(h.target)
+	r.InitialScan = h.started
+	healthy = true
+	ready = h.started && r.Reachable
+	for _, rh := range h.routines {
+		rr := routineReport{
+			Kind:      rh.kind,
+			Directory: rh.dir,
+			Alive:     rh.routine != nil && rh.routine.alive(),
+			Scanned:   rh.scanned,
+		}
+		if rh.retries != nil {
+			rr.RetryQueue = rh.retries.len()
+		}
+		if rh.routine != nil && !rr.Alive {
+			healthy = false
+		}
+		if !rr.Alive || !rr.Scanned || rr.RetryQueue >= h.maxRetryQueue {
+			ready = false
+		}
+		r.Routines = append(r.Routines, rr)
+	}
+	ready = ready && healthy
+	return
+}
+
+func (h *health) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	report, healthy, _ := h.report()
+	writeHealthReport(w, report, healthy)
+}
+
+func (h *health) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	report, _, ready := h.report()
+	writeHealthReport(w, report, ready)
+}
+
+func writeHealthReport(w http.ResponseWriter, report healthReport, ok bool) {
+	status := http.StatusOK
+	report.Status = "ok"
+	if !ok {
+		status = http.StatusServiceUnavailable
+		report.Status = "unavailable"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealth_Report(t *testing.T) {
+	target := "https://bigip"
+	h := &health{target: target, maxRetryQueue: 1}
+	rh := h.register("watch", "/tmp/test", newRetryQueue())
+
+	if _, healthy, ready := h.report(); !healthy || ready {
+		t.Errorf("health.report() while starting: got healthy=%v ready=%v; want healthy=true ready=false", healthy, ready)
+	}
+
+	h.setScanned(rh)
+	h.setRoutine(rh, &watchRoutine{doneCh: make(chan struct{})})
+	h.setStarted()
+
+	stats.setReachable(target, false)
+	if _, healthy, ready := h.report(); !healthy || ready {
+		t.Errorf("health.report() while unreachable: got healthy=%v ready=%v; want healthy=true ready=false", healthy, ready)
+	}
+
+	stats.setReachable(target, true)
+	if _, healthy, ready := h.report(); !healthy || !ready {
+		t.Errorf("health.report(): got healthy=%v ready=%v; want healthy=true ready=true", healthy, ready)
+	}
+
+	close(rh.routine.doneCh)
+	if _, healthy, ready := h.report(); healthy || ready {
+		t.Errorf("health.report() with dead routine: got healthy=%v ready=%v; want healthy=false ready=false", healthy, ready)
+	}
+}
+
+func TestHealth_ServeReadyz(t *testing.T) {
+	h := &health{target: "https://unknown-bigip", maxRetryQueue: 1}
+	rec := httptest.NewRecorder()
+	h.serveReadyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("health.serveReadyz(): got status %d; want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	var report healthReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("health.serveReadyz(): cannot decode body: %v", err)
+	}
+	if report.Status != "unavailable" {
+		t.Errorf("health.serveReadyz(): got status %q; want %q", report.Status, "unavailable")
+	}
+}
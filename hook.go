@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultHookTimeout is the time after which a hook command is killed when no
+// timeout is configured.
+const defaultHookTimeout = time.Minute
+
+// hookEnv describes the change a hook command is run for. It is passed to the
+// command through environment variables.
+type hookEnv struct {
+	Path     string // local file
+	Name     string // name of the object on the BigIP
+	Action   string // "create", "update" or "delete"
+	Checksum string // hex encoded SHA1 digest, empty for deletions
+	Target   string
+	Watch    string
+}
+
+func (e hookEnv) environ() []string {
+	return append(os.Environ(),
+		"F5_FILE="+e.Path,
+		"F5_IFILE="+e.Name,
+		"F5_ACTION="+e.Action,
+		"F5_CHECKSUM="+e.Checksum,
+		"F5_TARGET="+e.Target,
+		"F5_WATCH="+e.Watch,
+	)
+}
+
+// errHookTimeout is returned when a hook command does not complete in time.
+var errHookTimeout = errors.New("hook timed out")
+
+// runHook runs cmd with the system shell and returns its combined output. The
+// command is killed if it does not complete within timeout.
+func runHook(cmd string, env hookEnv, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	c := hookCommand(cmd)
+	c.Env = env.environ()
+	c.Dir = env.Watch
+	var out bytes.Buffer
+	c.Stdout = &out
+	c.Stderr = &out
+	if err := c.Start(); err != nil {
+		return "", err
+	}
+	var timedOut int32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		killHook(c)
+	})
+	err := c.Wait()
+	timer.Stop()
+	if atomic.LoadInt32(&timedOut) == 1 {
+		err = errHookTimeout
+	}
+	return strings.TrimSpace(out.String()), err
+}
+
+// runHook runs the hook command of the given kind, "pre" or "post", for the
+// change described by rec. A failure of the command is logged and returned.
+func (s *syncer) runHook(kind, cmd string, rec auditRecord, checksum string) error {
+	if cmd == "" {
+		return nil
+	}
+	env := hookEnv{
+		Path:     rec.Source,
+		Name:     rec.Object,
+		Action:   rec.Action,
+		Checksum: checksum,
+		Target:   s.target,
+		Watch:    s.cfg.Dir,
+	}
+	l := s.l.With(fields{"file": rec.Source, "iFile": rec.Object, "action": rec.Action, "hook": kind})
+	out, err := runHook(cmd, env, s.cfg.HookTimeout.Duration)
+	stats.observeHook(s.cfg.Dir, kind, err)
+	if err != nil {
+		l.Errorf("%s_hook failed for %q: %v: %s", kind, rec.Source, err, out)
+		return err
+	}
+	l.Infof("%s_hook succeeded for %q", kind, rec.Source)
+	if out != "" {
+		l.Debugf("%s_hook output: %s", kind, out)
+	}
+	return nil
+}
+
+// preHook runs the pre_hook command before rec is applied. The change must
+// not be applied when an error is returned.
+func (s *syncer) preHook(rec auditRecord) error {
+	if s.cfg.PreHook == "" {
+		return nil
+	}
+	var checksum string
+	if rec.Action != "delete" {
+		var err error
+		if checksum, err = s.checksum(rec.Source, "SHA1"); err != nil {
+			return err
+		}
+	}
+	return s.runHook("pre", s.cfg.PreHook, rec, checksum)
+}
+
+// postHook runs the post_hook command once rec has been applied and verified.
+// Its result is only logged.
+func (s *syncer) postHook(rec auditRecord) {
+	_, _, checksum := splitChecksum(rec.NewChecksum)
+	s.runHook("post", s.cfg.PostHook, rec, checksum)
+}
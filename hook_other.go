@@ -0,0 +1,21 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"os/exec"
+	"runtime"
+)
+
+// hookCommand returns the command running cmd with the system shell.
+func hookCommand(cmd string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", cmd)
+	}
+	return exec.Command("rc", "-c", cmd)
+}
+
+func killHook(c *exec.Cmd) {
+	c.Process.Kill()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRunHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook tests rely on a POSIX shell")
+	}
+	env := hookEnv{
+		Path:     "/tmp/test/index.html",
+		Name:     "index.html",
+		Action:   "update",
+		Checksum: "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3",
+	}
+	out, err := runHook(`echo "$F5_ACTION $F5_IFILE $F5_FILE $F5_CHECKSUM"`, env, 0)
+	if err != nil {
+		t.Fatalf("runHook: unexpected error %q", err.Error())
+	}
+	want := "update index.html /tmp/test/index.html a94a8fe5ccb19ba61c4c0873d391e987982fbbd3"
+	if out != want {
+		t.Errorf("runHook: got %q; want %q", out, want)
+	}
+
+	out, err = runHook("echo lint error >&2; exit 3", env, 0)
+	if err == nil {
+		t.Error("runHook: expected error on non-zero exit status, got nil")
+	}
+	if out != "lint error" {
+		t.Errorf("runHook: got output %q; want %q", out, "lint error")
+	}
+
+	if _, err = runHook("sleep 5", env, 50*time.Millisecond); err != errHookTimeout {
+		t.Errorf("runHook: got error %v; want %v", err, errHookTimeout)
+	}
+}
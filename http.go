@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// listenAddr splits addr into a network and an address suitable for
+// net.Listen. Addresses prefixed with "unix:" denote unix sockets, any other
+// address is a TCP one.
+func listenAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	return "tcp", addr
+}
+
+// listen binds addr. A unix socket left behind by a previous run is replaced
+// while any other file is kept, and the socket is only made accessible to
+// the user running the process since the endpoints are not authenticated.
+func listen(addr string) (net.Listener, error) {
+	network, address := listenAddr(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+	if fi, err := os.Lstat(address); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("cannot listen on %q: file exists and is not a socket", address)
+		}
+		if err := os.Remove(address); err != nil {
+			return nil, fmt.Errorf("cannot remove previous socket %q: %v", address, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot stat %q: %v", address, err)
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(address, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("cannot set permissions of socket %q: %v", address, err)
+	}
+	return ln, nil
+}
+
+// httpServers serves the optional HTTP endpoints, sharing a single listener
+// between the endpoints configured with the same address.
+type httpServers struct {
+	muxes   map[string]*http.ServeMux
+	servers []*http.Server
+}
+
+func newHTTPServers() *httpServers {
+	return &httpServers{muxes: make(map[string]*http.ServeMux)}
+}
+
+// handle registers h for the given pattern on the listener bound to addr.
+func (hs *httpServers) handle(addr, pattern string, h http.Handler) {
+	mux, ok := hs.muxes[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		hs.muxes[addr] = mux
+	}
+	mux.Handle(pattern, h)
+}
+
+// start binds all the listeners and serves them in the background.
+func (hs *httpServers) start(l logger) error {
+	addrs := make([]string, 0, len(hs.muxes))
+	for addr := range hs.muxes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		ln, err := listen(addr)
+		if err != nil {
+			hs.stop()
+			return err
+		}
+		srv := &http.Server{Handler: hs.muxes[addr]}
+		hs.servers = append(hs.servers, srv)
+		go func(addr string) {
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				l.Errorf("http server on %q stopped: %v", addr, err)
+			}
+		}(addr)
+		l.Noticef("listening on %q", addr)
+	}
+	return nil
+}
+
+func (hs *httpServers) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range hs.servers {
+		srv.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files that are not sockets are never removed.
+	path := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(path, []byte("test"), 0644); err != nil {
+		t.Fatal("setup: ", err)
+	}
+	if ln, err := listen("unix:" + path); err == nil {
+		ln.Close()
+		t.Errorf("listen(%q): expected error, got nil", path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("listen(%q): file removed: %v", path, err)
+	}
+
+	// The socket of a previous run is replaced.
+	sock := filepath.Join(dir, "control.sock")
+	ln, err := listen("unix:" + sock)
+	if err != nil {
+		t.Fatalf("listen(%q): unexpected error %q", sock, err.Error())
+	}
+	if fi, err := os.Stat(sock); err != nil {
+		t.Errorf("listen(%q): cannot stat socket: %v", sock, err)
+	} else if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("listen(%q): got permissions %v; want %v", sock, perm, os.FileMode(0600))
+	}
+	// Closing the listener removes the socket, hence a stale one is
+	// simulated by keeping the first listener open.
+	ln2, err := listen("unix:" + sock)
+	if err != nil {
+		t.Fatalf("listen(%q) on previous socket: unexpected error %q", sock, err.Error())
+	}
+	ln2.Close()
+	ln.Close()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+
+	"github.com/e-XpertSolutions/f5-rest-client/f5"
+	"github.com/e-XpertSolutions/f5-rest-client/f5/ltm"
+	"github.com/e-XpertSolutions/f5-rest-client/f5/sys"
+)
+
+// sysIFilePath is the iControl REST endpoint of the system iFiles.
+const sysIFilePath = "/mgmt/tm/sys/file/ifile"
+
+// ifileHandler uploads files as system iFiles and links them to LTM iFiles of
+// the same name.
+type ifileHandler struct{}
+
+func (ifileHandler) List(c *f5.Client) (map[string]struct{}, error) {
+	ltmClient := ltm.New(c)
+	ifilesList, err := ltmClient.IFile().ListAll()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{})
+	for _, item := range ifilesList.Items {
+		names[filepath.Base(item.FileName)] = struct{}{}
+	}
+	return names, nil
+}
+
+func (ifileHandler) Checksum(c *f5.Client, name string) (string, error) {
+	sysClient := sys.New(c)
+	ifile, err := sysClient.FileIFile().Get(name)
+	if err != nil {
+		return "", fmt.Errorf("cannot get ifile meta for %q: %v", name, err)
+	}
+	return ifile.Checksum, nil
+}
+
+// ifileChecksumsPageSize is the number of sys iFiles fetched per request by
+// Checksums.
+const ifileChecksumsPageSize = 500
+
+func (ifileHandler) Checksums(c *f5.Client) (map[string]string, error) {
+	checksums := make(map[string]string)
+	seen := make(map[string]bool) // full paths of the listed iFiles
+	for skip := 0; ; skip += ifileChecksumsPageSize {
+		var page struct {
+			Items []struct {
+				Name     string `json:"name"`
+				FullPath string `json:"fullPath"`
+				Checksum string `json:"checksum"`
+			} `json:"items"`
+			NextLink string `json:"nextLink"`
+		}
+		query := fmt.Sprintf("?$select=name,fullPath,checksum&$top=%d&$skip=%d", ifileChecksumsPageSize, skip)
+		if err := c.ReadQuery(sysIFilePath+query, &page); err != nil {
+			return nil, fmt.Errorf("cannot list sys ifiles: %v", err)
+		}
+		// The iFiles are managed in the Common partition only, the ones
+		// of the same name in other partitions are ignored.
+		var added int
+		for _, item := range page.Items {
+			if seen[item.FullPath] {
+				continue
+			}
+			seen[item.FullPath] = true
+			added++
+			if item.FullPath == "/"+defaultPartition+"/"+item.Name {
+				checksums[item.Name] = item.Checksum
+			}
+		}
+		// A BigIP ignoring $skip would send the same page over and over.
+		if page.NextLink == "" || added == 0 {
+			return checksums, nil
+		}
+	}
+}
+
+func (ifileHandler) Create(tx *f5.Client, name string, src *source) error {
+	localPath, err := src.upload(tx, name)
+	if err != nil {
+		return fmt.Errorf("an error occured while uploading %q: %v", src.path, err)
+	}
+	data := map[string]string{
+		"name":        name,
+		"source-path": "file:" + localPath,
+	}
+	if err := tx.ModQuery("POST", sysIFilePath, data); err != nil {
+		return fmt.Errorf("cannot create sys ifile %q: %v", name, err)
+	}
+
+	ltmClient := ltm.New(tx)
+	if err := ltmClient.IFile().Create(name, name); err != nil {
+		return fmt.Errorf("cannot create file %q in ltm ifiles: %v", src.path, err)
+	}
+
+	return nil
+}
+
+func (ifileHandler) Update(tx *f5.Client, name string, src *source) error {
+	localPath, err := src.upload(tx, name)
+	if err != nil {
+		return fmt.Errorf("an error occured while re-uploading %q: %v", src.path, err)
+	}
+	data := map[string]string{"source-path": "file:" + localPath}
+	if err := tx.ModQuery("PUT", sysIFilePath+"/"+name, data); err != nil {
+		return fmt.Errorf("cannot update sys ifile %q: %v", name, err)
+	}
+
+	ltmClient := ltm.New(tx)
+	if err := ltmClient.IFile().Edit(name, name); err != nil {
+		return fmt.Errorf("cannot update file %q in ltm ifiles: %v", src.path, err)
+	}
+
+	return nil
+}
+
+func (ifileHandler) Delete(tx *f5.Client, name string) error {
+	ltmClient := ltm.New(tx)
+	if err := ltmClient.IFile().Delete(name); err != nil {
+		return fmt.Errorf("cannot delete ltm ifile %q: %v", name, err)
+	}
+
+	sysClient := sys.New(tx)
+
+	if err := sysClient.FileIFile().Delete(name); err != nil {
+		return fmt.Errorf("cannot delete ifile %q: %v", name, err)
+	}
+
+	if err := sysClient.FileIFile().Delete(name); err != nil {
+		return fmt.Errorf("cannot delete ifile %q from disk: %v", name, err)
+	}
+
+	return nil
+}
+
+func (ifileHandler) Validate(name, path string) error {
+	if !objectNameRegexp.MatchString(name) {
+		return fmt.Errorf("%q is not a valid ifile name", name)
+	}
+	return nil
+}
+
+func (ifileHandler) References(c *f5.Client, name string) ([]string, error) {
+	ltmClient := ltm.New(c)
+	rules, err := ltmClient.Rule().ListAll()
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve list of ltm rules: %v", err)
+	}
+	re := ifileReferenceRegexp(name)
+	var refs []string
+	for _, rule := range rules.Items {
+		if re.MatchString(rule.APIAnonymous) {
+			refs = append(refs, rule.FullPath)
+		}
+	}
+	return refs, nil
+}
+
+// ifileReferenceRegexp returns a regular expression matching the ifile
+// commands of an iRule that use the named ifile, e.g. "[ifile get name]" or
+// "[ifile get /Common/name]".
+func ifileReferenceRegexp(name string) *regexp.Regexp {
+	return regexp.MustCompile(`ifile\s+\w+\s+["{]?(/[^/\s"{}\[\]]+/)?` + regexp.QuoteMeta(name) + `["}]?(\s|\]|$)`)
+}
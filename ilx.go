@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/e-XpertSolutions/f5-rest-client/f5"
+)
+
+const (
+	// ilxWorkspacesDir is where the BigIP stores the iRules LX workspaces of
+	// the Common partition.
+	ilxWorkspacesDir = "/var/ilx/workspaces/Common"
+
+	// fileTransferDir is where files sent to the iControl REST file-transfer
+	// endpoint are written.
+	fileTransferDir = "/var/config/rest/downloads"
+)
+
+type ilxWorkspace struct {
+	Name       string `json:"name"`
+	Extensions []struct {
+		Name string `json:"name"`
+	} `json:"extensions,omitempty"`
+}
+
+// ensureILXWorkspace creates the workspace and its extension when they do not
+// exist yet.
+func ensureILXWorkspace(f5Client *f5.Client, ws, ext string) error {
+	var workspace ilxWorkspace
+	found, err := readILXObject(f5Client, "/mgmt/tm/ilx/workspace/~Common~"+ws, &workspace)
+	if err != nil {
+		return fmt.Errorf("cannot read ilx workspace %q: %v", ws, err)
+	}
+	if !found {
+		data := map[string]string{"name": ws}
+		if err := f5Client.ModQuery("POST", "/mgmt/tm/ilx/workspace", data); err != nil {
+			return fmt.Errorf("cannot create ilx workspace %q: %v", ws, err)
+		}
+	}
+	for _, e := range workspace.Extensions {
+		if e.Name == ext {
+			return nil
+		}
+	}
+	data := map[string]string{"name": ws}
+	if err := f5Client.ModQuery("POST", "/mgmt/tm/ilx/workspace?options=extension,"+ext, data); err != nil {
+		return fmt.Errorf("cannot create extension %q in ilx workspace %q: %v", ext, ws, err)
+	}
+	return nil
+}
+
+// readILXObject retrieves the object located at restPath into v. It reports
+// whether the object exists, only a 404 response meaning that it does not.
+func readILXObject(f5Client *f5.Client, restPath string, v interface{}) (bool, error) {
+	req, err := f5Client.MakeRequest("GET", restPath, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := f5Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		return false, fmt.Errorf("unexpected status %q: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, fmt.Errorf("cannot decode response: %v", err)
+	}
+	return true, nil
+}
+
+// ilxRemotePath returns the location on the BigIP of the file rel, given
+// relatively to the root of the extension.
+func ilxRemotePath(cfg ilxConfig, rel string) string {
+	return path.Join(ilxWorkspacesDir, cfg.Workspace, "extensions", cfg.Extension, filepath.ToSlash(rel))
+}
+
+// isILXPluginFile reports whether a change of the file rel requires the
+// plugin to be reloaded.
+func isILXPluginFile(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	return rel == "index.js" || rel == "package.json"
+}
+
+func uploadILXFile(f5Client *f5.Client, cfg ilxConfig, rel, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("cannot read file %q: %v", localPath, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat file %q: %v", localPath, err)
+	}
+
+	tmpName := "f5-auto-uploader-ilx-" + cfg.Workspace + "-" + cfg.Extension + "-" +
+		strings.Replace(filepath.ToSlash(rel), "/", "_", -1)
+	if _, err := f5Client.UploadFile(f, tmpName, info.Size()); err != nil {
+		return fmt.Errorf("an error occured while uploading %q: %v", localPath, err)
+	}
+
+	dst := ilxRemotePath(cfg, rel)
+	cmd := "mkdir -p " + shellQuote(path.Dir(dst)) +
+		" && mv -f " + shellQuote(path.Join(fileTransferDir, tmpName)) + " " + shellQuote(dst)
+	if err := runBash(f5Client, cmd); err != nil {
+		return fmt.Errorf("cannot move %q into ilx workspace %q: %v", localPath, cfg.Workspace, err)
+	}
+	return nil
+}
+
+func deleteILXFile(f5Client *f5.Client, cfg ilxConfig, rel string) error {
+	if err := runBash(f5Client, "rm -f "+shellQuote(ilxRemotePath(cfg, rel))); err != nil {
+		return fmt.Errorf("cannot delete %q from ilx workspace %q: %v", rel, cfg.Workspace, err)
+	}
+	return nil
+}
+
+// reloadILXPlugin creates the plugin from the workspace or, when it already
+// exists, reloads it so that it picks up the new content of the workspace.
+func reloadILXPlugin(f5Client *f5.Client, cfg ilxConfig) error {
+	data := map[string]string{
+		"name":          cfg.Plugin,
+		"fromWorkspace": "/Common/" + cfg.Workspace,
+	}
+	var plugin struct {
+		Name string `json:"name"`
+	}
+	found, err := readILXObject(f5Client, "/mgmt/tm/ilx/plugin/~Common~"+cfg.Plugin, &plugin)
+	if err != nil {
+		return fmt.Errorf("cannot read ilx plugin %q: %v", cfg.Plugin, err)
+	}
+	if !found {
+		if err := f5Client.ModQuery("POST", "/mgmt/tm/ilx/plugin", data); err != nil {
+			return fmt.Errorf("cannot create ilx plugin %q: %v", cfg.Plugin, err)
+		}
+		return nil
+	}
+	if err := f5Client.ModQuery("PATCH", "/mgmt/tm/ilx/plugin/~Common~"+cfg.Plugin, data); err != nil {
+		return fmt.Errorf("cannot reload ilx plugin %q: %v", cfg.Plugin, err)
+	}
+	return nil
+}
+
+// runBash runs cmd on the BigIP through the bash utility endpoint. The
+// endpoint answers with a success status even when the command fails, hence
+// cmd must not write anything on success: any output is reported as an error.
+// The exit status of a failed command is written as well, in case it does not
+// write anything.
+func runBash(f5Client *f5.Client, cmd string) error {
+	data := map[string]string{
+		"command":     "run",
+		"utilCmdArgs": "-c " + shellQuote("("+cmd+") 2>&1 || echo \"exit status $?\""),
+	}
+	req, err := f5Client.MakeRequest("POST", "/mgmt/tm/util/bash", data)
+	if err != nil {
+		return err
+	}
+	resp, err := f5Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %q: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var result struct {
+		CommandResult string `json:"commandResult"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("cannot decode response: %v", err)
+	}
+	if out := strings.TrimSpace(result.CommandResult); out != "" {
+		return fmt.Errorf("command failed: %s", out)
+	}
+	return nil
+}
+
+// shellQuote quotes s so that it is interpreted as a single word by a POSIX
+// shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// syncILX uploads the whole local directory tree into the extension and then
+// reloads the plugin, if any.
+func syncILX(f5Client *f5.Client, l logger, cfg ilxConfig, filter *fileFilter) error {
+	l = l.With(fields{"watch": cfg.Dir, "workspace": cfg.Workspace})
+	if err := ensureILXWorkspace(f5Client, cfg.Workspace, cfg.Extension); err != nil {
+		return err
+	}
+	l.Noticef("synchronising %q with ilx workspace %q", cfg.Dir, cfg.Workspace)
+	err := filepath.Walk(cfg.Dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != cfg.Dir && filter.skip(p, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(cfg.Dir, p)
+		if err != nil {
+			return err
+		}
+		return uploadILXFile(f5Client, cfg, rel, p)
+	})
+	if err != nil {
+		return err
+	}
+	if cfg.Plugin != "" {
+		return reloadILXPlugin(f5Client, cfg)
+	}
+	return nil
+}
+
+// watchILX keeps the extension of the workspace in sync with the local
+// directory tree.
+func watchILX(f5Client *f5.Client, l logger, cfg ilxConfig, filter *fileFilter) (*watchRoutine, error) {
+	l = l.With(fields{"watch": cfg.Dir, "workspace": cfg.Workspace})
+	return newWatchRoutine(cfg.Dir, true, filter, cfg.Debounce.Duration, l, nil, func(events []watchEvent) {
+		var reload bool
+		for _, e := range events {
+			if filter.isIgnoreFile(e.Name) {
+				if err := filter.reload(); err != nil {
+					l.Errorf("keeping previous ignore patterns: %v", err)
+				} else {
+					l.Noticef("ignore patterns reloaded from %q", e.Name)
+				}
+				continue
+			}
+			if filter.skip(e.Name, false) {
+				continue
+			}
+			rel, err := filepath.Rel(cfg.Dir, e.Name)
+			if err != nil {
+				l.Errorf("cannot compute path of %q relatively to %q: %v", e.Name, cfg.Dir, err)
+				continue
+			}
+			if e.isRemove() || e.isRename() {
+				l.Noticef("removing %q from ilx workspace %q", rel, cfg.Workspace)
+				err = deleteILXFile(f5Client, cfg, rel)
+			} else {
+				l.Noticef("uploading %q into ilx workspace %q", rel, cfg.Workspace)
+				err = uploadILXFile(f5Client, cfg, rel, e.Name)
+			}
+			if err != nil {
+				l.Error(err)
+				continue
+			}
+			if isILXPluginFile(rel) {
+				reload = true
+			}
+		}
+		if reload && cfg.Plugin != "" {
+			l.Noticef("reloading ilx plugin %q", cfg.Plugin)
+			if err := reloadILXPlugin(f5Client, cfg); err != nil {
+				l.Error(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/e-XpertSolutions/f5-rest-client/f5"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"foo", "'foo'"},
+		{"foo bar", "'foo bar'"},
+		{"it's", `'it'\''s'`},
+		{"", "''"},
+	}
+	for _, test := range tests {
+		if got := shellQuote(test.in); got != test.want {
+			t.Errorf("shellQuote(%q): got %q; want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestILXRemotePath(t *testing.T) {
+	cfg := ilxConfig{Workspace: "ws", Extension: "ext"}
+	want := "/var/ilx/workspaces/Common/ws/extensions/ext/lib/util.js"
+	if got := ilxRemotePath(cfg, "lib/util.js"); got != want {
+		t.Errorf("ilxRemotePath(%q): got %q; want %q", "lib/util.js", got, want)
+	}
+}
+
+func TestIsILXPluginFile(t *testing.T) {
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"index.js", true},
+		{"package.json", true},
+		{"lib/index.js", false},
+		{"node_modules/foo/package.json", false},
+		{"README.md", false},
+	}
+	for _, test := range tests {
+		if got := isILXPluginFile(test.rel); got != test.want {
+			t.Errorf("isILXPluginFile(%q): got %v; want %v", test.rel, got, test.want)
+		}
+	}
+}
+
+func TestEnsureILXWorkspace(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		workspace string
+		wantPosts []string
+		wantErr   bool
+	}{
+		{"missing", http.StatusNotFound, "", []string{"/mgmt/tm/ilx/workspace", "/mgmt/tm/ilx/workspace?options=extension,ext"}, false},
+		{"no extension", http.StatusOK, `{"name":"ws"}`, []string{"/mgmt/tm/ilx/workspace?options=extension,ext"}, false},
+		{"complete", http.StatusOK, `{"name":"ws","extensions":[{"name":"ext"}]}`, nil, false},
+		{"unavailable", http.StatusServiceUnavailable, "", nil, true},
+		{"unauthorized", http.StatusUnauthorized, "", nil, true},
+	}
+	for _, test := range tests {
+		var (
+			mu    sync.Mutex
+			posts []string
+		)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch r.Method {
+			case "GET":
+				if test.status != http.StatusOK {
+					http.Error(w, "failure", test.status)
+					return
+				}
+				fmt.Fprint(w, test.workspace)
+			case "POST":
+				posts = append(posts, r.URL.RequestURI())
+			}
+		}))
+		c, err := f5.NewBasicClient(ts.URL, "admin", "admin")
+		if err != nil {
+			t.Fatal("setup: ", err)
+		}
+		err = ensureILXWorkspace(c, "ws", "ext")
+		ts.Close()
+		if test.wantErr && err == nil {
+			t.Errorf("ensureILXWorkspace(%s): expected error, got nil", test.name)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("ensureILXWorkspace(%s): unexpected error %q", test.name, err.Error())
+		}
+		if strings.Join(posts, ",") != strings.Join(test.wantPosts, ",") {
+			t.Errorf("ensureILXWorkspace(%s): got POST requests %q; want %q", test.name, posts, test.wantPosts)
+		}
+	}
+}
+
+func TestRunBash(t *testing.T) {
+	tests := []struct {
+		status  int
+		body    string
+		wantErr bool
+	}{
+		{http.StatusOK, `{"command":"run"}`, false},
+		{http.StatusOK, `{"command":"run","commandResult":""}`, false},
+		{http.StatusOK, `{"command":"run","commandResult":"mv: cannot stat 'a': No such file or directory\nexit status 1\n"}`, true},
+		{http.StatusOK, `not json`, true},
+		{http.StatusUnauthorized, `{"code":401}`, true},
+	}
+	for _, test := range tests {
+		var args string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var data map[string]string
+			json.NewDecoder(r.Body).Decode(&data)
+			args = data["utilCmdArgs"]
+			w.WriteHeader(test.status)
+			fmt.Fprint(w, test.body)
+		}))
+		c, err := f5.NewBasicClient(ts.URL, "admin", "admin")
+		if err != nil {
+			t.Fatal("setup: ", err)
+		}
+		err = runBash(c, "rm -f /tmp/a")
+		ts.Close()
+		if test.wantErr && err == nil {
+			t.Errorf("runBash(%q): expected error, got nil", test.body)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("runBash(%q): unexpected error %q", test.body, err.Error())
+		}
+		if !strings.Contains(args, "rm -f /tmp/a") {
+			t.Errorf("runBash(): got arguments %q; want them to contain the command", args)
+		}
+	}
+}
+
+func TestReloadILXPlugin(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		wantReqs []string
+		wantErr  bool
+	}{
+		{"missing", http.StatusNotFound, []string{"POST /mgmt/tm/ilx/plugin"}, false},
+		{"existing", http.StatusOK, []string{"PATCH /mgmt/tm/ilx/plugin/~Common~plugin"}, false},
+		{"unavailable", http.StatusServiceUnavailable, nil, true},
+		{"unauthorized", http.StatusUnauthorized, nil, true},
+	}
+	for _, test := range tests {
+		var (
+			mu   sync.Mutex
+			reqs []string
+		)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if r.Method != "GET" {
+				reqs = append(reqs, r.Method+" "+r.URL.Path)
+				fmt.Fprint(w, "{}")
+				return
+			}
+			if test.status != http.StatusOK {
+				http.Error(w, "failure", test.status)
+				return
+			}
+			fmt.Fprint(w, `{"name":"plugin"}`)
+		}))
+		c, err := f5.NewBasicClient(ts.URL, "admin", "admin")
+		if err != nil {
+			t.Fatal("setup: ", err)
+		}
+		err = reloadILXPlugin(c, ilxConfig{Workspace: "ws", Extension: "ext", Plugin: "plugin"})
+		ts.Close()
+		if test.wantErr && err == nil {
+			t.Errorf("reloadILXPlugin(%s): expected error, got nil", test.name)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("reloadILXPlugin(%s): unexpected error %q", test.name, err.Error())
+		}
+		if strings.Join(reqs, ",") != strings.Join(test.wantReqs, ",") {
+			t.Errorf("reloadILXPlugin(%s): got requests %q; want %q", test.name, reqs, test.wantReqs)
+		}
+	}
+}
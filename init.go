@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/howeyc/gopass"
+)
+
+// readPassword prints prompt and reads a password from the terminal without
+// echoing it. It is wrapped into a variable function in order to ease
+// testing.
+var readPassword = func(prompt string) (string, error) {
+	fmt.Fprint(stdout, prompt)
+	pass, err := gopass.GetPasswd()
+	if err != nil {
+		return "", err
+	}
+	return string(pass), nil
+}
+
+// initAnswers holds the settings asked by the init command.
+type initAnswers struct {
+	F5                f5Config
+	CredentialStorage string
+	SecretStorePath   string
+	Passphrase        string
+	Dirs              []string
+}
+
+// prompter asks questions on w and reads the answers from r.
+type prompter struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+// ask asks question and returns the answer, or def if the answer is empty.
+func (p *prompter) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.w, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.w, "%s: ", question)
+	}
+	line, err := p.r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.New("cannot read answer: " + err.Error())
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+// choose asks question until the answer is one of choices.
+func (p *prompter) choose(question, def string, choices ...string) (string, error) {
+	for {
+		answer, err := p.ask(fmt.Sprintf("%s (%s)", question, strings.Join(choices, "/")), def)
+		if err != nil {
+			return "", err
+		}
+		for _, c := range choices {
+			if strings.EqualFold(answer, c) {
+				return c, nil
+			}
+		}
+		fmt.Fprintf(p.w, "invalid answer %q\n", answer)
+	}
+}
+
+// confirm asks a yes/no question.
+func (p *prompter) confirm(question string, def bool) (bool, error) {
+	d := "n"
+	if def {
+		d = "y"
+	}
+	answer, err := p.choose(question, d, "y", "n")
+	return answer == "y", err
+}
+
+// askPassword reads a password, twice when confirm is set, until a non-empty
+// password is given.
+func askPassword(prompt string, confirm bool) (string, error) {
+	for {
+		pass, err := readPassword(prompt + ": ")
+		if err != nil {
+			return "", errors.New("cannot read password: " + err.Error())
+		}
+		if pass == "" {
+			continue
+		}
+		if !confirm {
+			return pass, nil
+		}
+		again, err := readPassword("Confirm " + strings.ToLower(prompt[:1]) + prompt[1:] + ": ")
+		if err != nil {
+			return "", errors.New("cannot read password: " + err.Error())
+		}
+		if pass == again {
+			return pass, nil
+		}
+		fmt.Fprintln(stdout, "passwords do not match")
+	}
+}
+
+// askInitAnswers asks the settings of the configuration to create.
+func askInitAnswers(p *prompter, cfgPath string) (*initAnswers, error) {
+	var (
+		ans initAnswers
+		err error
+	)
+	for {
+		if ans.F5.URL, err = p.ask("BigIP URL", "https://"); err != nil {
+			return nil, err
+		}
+		if err = checkURL(ans.F5.URL); err == nil {
+			break
+		}
+		fmt.Fprintln(p.w, err)
+	}
+	if ans.F5.AuthMethod, err = p.choose("Authentication method", "basic", "basic", "token"); err != nil {
+		return nil, err
+	}
+	if ans.F5.AuthMethod == "token" {
+		if ans.F5.LoginProviderName, err = p.ask("Login provider name", "tmos"); err != nil {
+			return nil, err
+		}
+	}
+	if ans.F5.SSLCheck, err = p.confirm("Check the TLS certificate of the BigIP", true); err != nil {
+		return nil, err
+	}
+	for ans.F5.User == "" {
+		if ans.F5.User, err = p.ask("Username", ""); err != nil {
+			return nil, err
+		}
+	}
+	if ans.F5.Password, err = askPassword("Password", false); err != nil {
+		return nil, err
+	}
+
+	if ans.CredentialStorage, err = p.choose("Credential storage", "secret", "secret", "plain"); err != nil {
+		return nil, err
+	}
+	if ans.CredentialStorage == "secret" {
+		def := filepath.Join(filepath.Dir(cfgPath), "credentials.secret")
+		if ans.SecretStorePath, err = p.ask("Secret store path", def); err != nil {
+			return nil, err
+		}
+		if ans.Passphrase, err = askPassword("Secret store passphrase", true); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		dir, err := p.ask("Directory to watch (empty to finish)", "")
+		if err != nil {
+			return nil, err
+		}
+		if dir == "" {
+			break
+		}
+		var errs configErrors
+		if checkDir(&errs, dir, dir); len(errs) > 0 {
+			fmt.Fprintln(p.w, errs[0])
+			continue
+		}
+		ans.Dirs = append(ans.Dirs, dir)
+	}
+	return &ans, nil
+}
+
+// tomlString quotes s as a TOML basic string.
+func tomlString(s string) string {
+	var buf []byte
+	buf = append(buf, '"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			buf = append(buf, '\\', byte(r))
+		case r < 0x20 || r == 0x7f:
+			buf = append(buf, fmt.Sprintf(`\u%04X`, r)...)
+		default:
+			buf = append(buf, string(r)...)
+		}
+	}
+	return string(append(buf, '"'))
+}
+
+var initConfigTemplate = template.Must(template.New("config").Funcs(template.FuncMap{
+	"quote": tomlString,
+}).Parse(`# Configuration generated by f5-auto-uploader init. See config.toml.sample
+# for all the available settings.
+{{if eq .CredentialStorage "secret"}}
+# The username and password are read from the secret store, unlocked with the
+# passphrase given as token.
+credential_storage = "secret"
+secret_store_path = {{quote .SecretStorePath}}
+token = {{quote .Passphrase}}
+{{else}}
+credential_storage = "plain"
+{{end}}
+[f5]
+auth_method = {{quote .F5.AuthMethod}}
+url = {{quote .F5.URL}}
+{{- if .F5.LoginProviderName}}
+login_provider_name = {{quote .F5.LoginProviderName}}
+{{- end}}
+ssl_check = {{.F5.SSLCheck}}
+{{- if eq .CredentialStorage "plain"}}
+user = {{quote .F5.User}}
+password = {{quote .F5.Password}}
+{{- end}}
+{{range .Dirs}}
+[[watch]]
+type = "ifile"
+directory = {{quote .}}
+exclude = [".*"]
+#remove_remote_files = false
+{{end}}`))
+
+// writeInitConfig writes the configuration file described by ans at path. The
+// file is only readable by its owner as it may contain credentials.
+func writeInitConfig(path string, ans *initAnswers) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create configuration file: %v", err)
+	}
+	if err := initConfigTemplate.Execute(f, ans); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write configuration file: %v", err)
+	}
+	return f.Close()
+}
+
+func initUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "usage: %s init [flags]\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+		exit(1)
+	}
+}
+
+// runInit implements the init sub-command which interactively creates the
+// configuration file and, if needed, the secret store.
+func runInit(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	fs.Usage = initUsage(fs)
+	cfgPath := fs.String("config", "config.toml", "path of the configuration file to create")
+	force := fs.Bool("force", false, "overwrite existing configuration file and secret store")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return
+	}
+
+	if _, err := os.Stat(*cfgPath); err == nil && !*force {
+		fatal(fmt.Sprintf("configuration file %q already exists, use -force to overwrite it", *cfgPath))
+		return
+	}
+
+	p := &prompter{r: bufio.NewReader(stdin), w: stdout}
+	ans, err := askInitAnswers(p, *cfgPath)
+	if err != nil {
+		fatal(err)
+		return
+	}
+	if ans.CredentialStorage == "secret" && !*force {
+		if _, err := os.Stat(ans.SecretStorePath); err == nil {
+			fatal(fmt.Sprintf("secret store %q already exists, use -force to overwrite it", ans.SecretStorePath))
+			return
+		}
+	}
+
+	f5Client, err := initF5Client(ans.F5)
+	if err != nil {
+		fatal(err)
+		return
+	}
+	if f5Client.IsActive() {
+		info(fmt.Sprintf("big-ip instance %q is available", ans.F5.URL))
+	} else {
+		ok, err := p.confirm(fmt.Sprintf("big-ip instance %q is not available, write the configuration anyway", ans.F5.URL), false)
+		if err != nil {
+			fatal(err)
+			return
+		}
+		if !ok {
+			exit(1)
+			return
+		}
+	}
+
+	if ans.CredentialStorage == "secret" {
+		creds := map[string]credentials{"": {ans.F5.User, ans.F5.Password}}
+		if err := writeSecretStore(ans.SecretStorePath, ans.Passphrase, creds); err != nil {
+			fatal(err)
+			return
+		}
+		info(fmt.Sprintf("secret store written to %q", ans.SecretStorePath))
+	}
+	if err := writeInitConfig(*cfgPath, ans); err != nil {
+		fatal(err)
+		return
+	}
+	info(fmt.Sprintf("configuration written to %q", *cfgPath))
+}
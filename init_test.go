@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// scriptInit replaces the standard input and the password prompt with the
+// given answers and returns a function restoring them.
+func scriptInit(answers string, passwords ...string) func() {
+	oldStdin, oldStdout, oldReadPassword := stdin, stdout, readPassword
+	stdin = strings.NewReader(answers)
+	stdout = new(bytes.Buffer)
+	readPassword = func(string) (string, error) {
+		pass := passwords[0]
+		passwords = passwords[1:]
+		return pass, nil
+	}
+	return func() {
+		stdin, stdout, readPassword = oldStdin, oldStdout, oldReadPassword
+	}
+}
+
+func TestRunInitSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+	cfgPath := filepath.Join(dir, "config.toml")
+	storePath := filepath.Join(dir, "secrets", "store")
+
+	answers := strings.Join([]string{
+		"ftp://bigip",    // invalid URL, asked again
+		"https://bigip",  // URL
+		"",               // auth method, basic by default
+		"n",              // SSL check
+		"admin",          // username
+		"secret",         // credential storage
+		storePath,        // secret store path
+		dir + "/missing", // invalid directory, asked again
+		dir,              // directory to watch
+		"",               // done
+	}, "\n") + "\n"
+	defer scriptInit(answers, "s3cr3t", "passphrase", "passphrase")()
+
+	runInit([]string{"-config", cfgPath})
+
+	cfg, err := readConfig(cfgPath)
+	if err != nil {
+		t.Fatalf("runInit: invalid configuration file: %v", err)
+	}
+	if cfg.F5.URL != "https://bigip" || cfg.F5.AuthMethod != "basic" || cfg.F5.SSLCheck {
+		t.Errorf("runInit: got f5 configuration %+v", cfg.F5)
+	}
+	if cfg.CredentialStorage != "secret" || cfg.SecretStorePath != storePath || cfg.Passphrase != "passphrase" {
+		t.Errorf("runInit: got credential storage %q, store %q, token %q",
+			cfg.CredentialStorage, cfg.SecretStorePath, cfg.Passphrase)
+	}
+	if len(cfg.Watch) != 1 || cfg.Watch[0].Dir != dir {
+		t.Errorf("runInit: got watches %+v; want a single watch of %q", cfg.Watch, dir)
+	}
+
+	user, pass, err := readUserCredentials(storePath, "passphrase", "bigip")
+	if err != nil {
+		t.Fatalf("readUserCredentials(%q): unexpected error %q", storePath, err.Error())
+	}
+	if user != "admin" || pass != "s3cr3t" {
+		t.Errorf("readUserCredentials(%q): got %q/%q; want %q/%q", storePath, user, pass, "admin", "s3cr3t")
+	}
+	for _, path := range []string{cfgPath, storePath} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm&0077 != 0 {
+			t.Errorf("runInit: %q has permissions %v; want none for group and others", path, perm)
+		}
+	}
+}
+
+func TestInitConfigTemplatePlain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.toml")
+
+	ans := &initAnswers{
+		F5: f5Config{
+			AuthMethod:        "token",
+			URL:               "https://bigip",
+			User:              "admin",
+			Password:          `p"a\ss`,
+			LoginProviderName: "tmos",
+		},
+		CredentialStorage: "plain",
+		Dirs:              []string{dir},
+	}
+	if err := writeInitConfig(path, ans); err != nil {
+		t.Fatalf("writeInitConfig: unexpected error %q", err.Error())
+	}
+	cfg, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("writeInitConfig: invalid configuration file: %v", err)
+	}
+	if cfg.F5 != ans.F5 {
+		t.Errorf("writeInitConfig: got f5 configuration %+v; want %+v", cfg.F5, ans.F5)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// inode always returns 0 since inode numbers are not available on this
+// platform.
+func inode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journaldSocket is the socket on which journald receives native messages.
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldSink sends the log entries to journald using its native protocol,
+// the fields of the entries being sent as journal fields. As for syslog, the
+// entries are dropped for a while when journald cannot be reached.
+type journaldSink struct {
+	mu      sync.Mutex
+	tag     string
+	min     level
+	dial    func(network, address string) (net.Conn, error)
+	conn    net.Conn
+	backoff time.Duration
+	retryAt time.Time // no dial is attempted before
+	dropped int       // entries dropped while journald was unreachable
+}
+
+func newJournaldSink(tag string, min level) *journaldSink {
+	return &journaldSink{tag: tag, min: min, dial: net.Dial}
+}
+
+func (js *journaldSink) write(e logEntry) {
+	if e.level < js.min {
+		return
+	}
+	msg := formatJournald(e, js.tag)
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if js.conn == nil {
+		if time.Now().Before(js.retryAt) {
+			js.dropped++
+			return
+		}
+		if err := js.connect(); err != nil {
+			js.dropped++
+			return
+		}
+	}
+	if _, err := js.conn.Write(msg); err != nil {
+		js.conn.Close()
+		js.conn = nil
+		fmt.Fprintf(stderr, "cannot write log entry to journald: %v\n", err)
+	}
+}
+
+// connect dials journald. On failure, no other attempt is made until the
+// backoff delay expires. Callers must hold js.mu.
+func (js *journaldSink) connect() error {
+	conn, err := js.dial("unixgram", journaldSocket)
+	if err != nil {
+		if js.backoff == 0 {
+			js.backoff = syslogMinBackoff
+		} else if js.backoff *= 2; js.backoff > syslogMaxBackoff {
+			js.backoff = syslogMaxBackoff
+		}
+		js.retryAt = time.Now().Add(js.backoff)
+		fmt.Fprintf(stderr, "cannot connect to journald, dropping log entries for %v: %v\n", js.backoff, err)
+		return err
+	}
+	if js.dropped > 0 {
+		fmt.Fprintf(stderr, "connected to journald again, %d log entries were dropped\n", js.dropped)
+	}
+	js.conn = conn
+	js.backoff = 0
+	js.dropped = 0
+	return nil
+}
+
+// formatJournald encodes e in the journald native protocol.
+func formatJournald(e logEntry, tag string) []byte {
+	buf := new(bytes.Buffer)
+	writeJournaldField(buf, "MESSAGE", e.msg)
+	writeJournaldField(buf, "PRIORITY", strconv.Itoa(syslogSeverity(e.level)))
+	if tag != "" {
+		writeJournaldField(buf, "SYSLOG_IDENTIFIER", tag)
+	}
+	keys := make([]string, 0, len(e.fields))
+	for k := range e.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeJournaldField(buf, journaldFieldName(k), fmt.Sprint(e.fields[k]))
+	}
+	return buf.Bytes()
+}
+
+// writeJournaldField writes a single field. Values spanning several lines are
+// prefixed with their length as mandated by the protocol.
+func writeJournaldField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+	buf.WriteString(name + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+// journaldFieldName turns k into a valid journal field name: upper case
+// letters, digits and underscores, not starting with an underscore.
+func journaldFieldName(k string) string {
+	b := []byte(strings.ToUpper(k))
+	for i, c := range b {
+		if !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	name := strings.TrimLeft(string(b), "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "F" + name
+	}
+	return name
+}
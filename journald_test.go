@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatJournald(t *testing.T) {
+	e := logEntry{
+		level:  levelWarn,
+		msg:    "two\nlines",
+		fields: fields{"iFile": "index.html", "tx_id": "123"},
+	}
+	got := string(formatJournald(e, "f5-auto-uploader"))
+	want := "MESSAGE\n\x09\x00\x00\x00\x00\x00\x00\x00two\nlines\n" +
+		"PRIORITY=4\n" +
+		"SYSLOG_IDENTIFIER=f5-auto-uploader\n" +
+		"IFILE=index.html\n" +
+		"TX_ID=123\n"
+	if got != want {
+		t.Errorf("formatJournald(): got %q; want %q", got, want)
+	}
+}
+
+func TestJournaldSink_Backoff(t *testing.T) {
+	oldStderr := stderr
+	defer func() { stderr = oldStderr }()
+	buf := new(bytes.Buffer)
+	stderr = buf
+
+	sink := newJournaldSink("test", levelInfo)
+	var dials int
+	sink.dial = func(network, address string) (net.Conn, error) {
+		dials++
+		return nil, errors.New("no such file or directory")
+	}
+	l := newSinkLogger(sink)
+	for i := 0; i < 3; i++ {
+		l.Error("test")
+	}
+	if dials != 1 {
+		t.Errorf("journaldSink.write(): got %d dials while journald is down; want 1", dials)
+	}
+	if sink.backoff != syslogMinBackoff {
+		t.Errorf("journaldSink.write(): got backoff %v; want %v", sink.backoff, syslogMinBackoff)
+	}
+
+	// Once the delay expired, the sink dials again and doubles the delay
+	// on failure.
+	sink.retryAt = time.Time{}
+	l.Error("test")
+	if dials != 2 || sink.backoff != 2*syslogMinBackoff {
+		t.Errorf("journaldSink.write(): got %d dials and backoff %v; want 2 and %v", dials, sink.backoff, 2*syslogMinBackoff)
+	}
+
+	// The dropped entries are reported once journald is reachable again.
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+	sink.dial = func(network, address string) (net.Conn, error) {
+		return client, nil
+	}
+	sink.retryAt = time.Time{}
+	l.Error("test")
+	if want := "4 log entries were dropped"; !strings.Contains(buf.String(), want) {
+		t.Errorf("journaldSink.write(): stderr does not contain %q:\n%s", want, buf.String())
+	}
+	if sink.backoff != 0 || sink.dropped != 0 {
+		t.Errorf("journaldSink.write(): got backoff %v and %d dropped entries after reconnection; want 0", sink.backoff, sink.dropped)
+	}
+}
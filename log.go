@@ -1,38 +1,298 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// level is the severity of a log message.
+type level int
+
+const (
+	levelDebug level = iota
+	levelInfo
+	levelNotice
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "notice", "warn", "error"}
+
+func (lvl level) String() string {
+	if lvl < levelDebug || lvl > levelError {
+		return fmt.Sprintf("level(%d)", int(lvl))
+	}
+	return levelNames[lvl]
+}
+
+// parseLevel returns the level named s. An empty string stands for the
+// "info" level.
+func parseLevel(s string) (level, error) {
+	if s == "" {
+		return levelInfo, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// fields are the structured data attached to a log message.
+type fields map[string]interface{}
+
 type logger interface {
-	Error(v ...interface{})
-	Errorf(format string, v ...interface{})
+	Debug(v ...interface{})
+	Debugf(format string, v ...interface{})
+	Info(v ...interface{})
+	Infof(format string, v ...interface{})
 	Notice(v ...interface{})
 	Noticef(format string, v ...interface{})
+	Warn(v ...interface{})
+	Warnf(format string, v ...interface{})
+	Error(v ...interface{})
+	Errorf(format string, v ...interface{})
+
+	// With returns a logger that attaches f to every message, in addition to
+	// the fields of the current logger.
+	With(f fields) logger
+}
+
+// logEntry is a single log message.
+type logEntry struct {
+	time   time.Time
+	level  level
+	msg    string
+	fields fields
+}
+
+// logSink is a destination for log entries. Each sink discards the entries
+// below its own minimum level.
+type logSink interface {
+	write(e logEntry)
+}
+
+// writerSink writes the log entries to an io.Writer in either the "text" or
+// the "json" format.
+type writerSink struct {
+	mu     sync.Mutex
+	l      *log.Logger // text format
+	w      io.Writer   // json format
+	format string
+	min    level
+}
+
+// newWriterSink returns a sink writing entries of level min and above to w.
+func newWriterSink(w io.Writer, format string, min level) (*writerSink, error) {
+	switch format {
+	case "", "text":
+		format = "text"
+	case "json":
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return &writerSink{
+		l:      log.New(w, "", log.LstdFlags),
+		w:      w,
+		format: format,
+		min:    min,
+	}, nil
+}
+
+func (ws *writerSink) write(e logEntry) {
+	if e.level < ws.min {
+		return
+	}
+	if ws.format == "json" {
+		data := make(map[string]interface{}, len(e.fields)+3)
+		for k, v := range e.fields {
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			data[k] = v
+		}
+		data["time"] = e.time.Format(time.RFC3339Nano)
+		data["level"] = e.level.String()
+		data["msg"] = e.msg
+		b, err := json.Marshal(data)
+		if err != nil {
+			b, _ = json.Marshal(map[string]string{
+				"time":  e.time.Format(time.RFC3339Nano),
+				"level": levelError.String(),
+				"msg":   "cannot encode log entry: " + err.Error(),
+			})
+		}
+		ws.mu.Lock()
+		ws.w.Write(append(b, '\n'))
+		ws.mu.Unlock()
+		return
+	}
+	ws.l.Printf("[%s] %s%s", e.level, e.msg, formatFields(e.fields))
+}
+
+// formatFields formats f as a list of key=value pairs sorted by key.
+func formatFields(f fields) string {
+	if len(f) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := new(bytes.Buffer)
+	for _, k := range keys {
+		v := fmt.Sprint(f[k])
+		if v == "" || strings.ContainsAny(v, " \t\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(buf, " %s=%s", k, v)
+	}
+	return buf.String()
 }
 
 type defaultLogger struct {
-	l *log.Logger
+	sinks  []logSink
+	fields fields
 }
 
+// newLogger returns a logger writing text messages of level info and above
+// to w.
 func newLogger(w io.Writer) logger {
-	return &defaultLogger{l: log.New(w, "", log.LstdFlags)}
+	l, _ := newFormattedLogger(w, "text", levelInfo)
+	return l
 }
 
-func (dl defaultLogger) Error(v ...interface{}) {
-	dl.l.Print("[error] ", fmt.Sprint(v...))
+// newFormattedLogger returns a logger writing messages of level min and above
+// to w, either as plain text or as JSON lines.
+func newFormattedLogger(w io.Writer, format string, min level) (logger, error) {
+	ws, err := newWriterSink(w, format, min)
+	if err != nil {
+		return nil, err
+	}
+	return newSinkLogger(ws), nil
 }
 
-func (dl defaultLogger) Errorf(format string, v ...interface{}) {
-	dl.l.Print("[error] ", fmt.Sprintf(format, v...))
+// newSinkLogger returns a logger writing to all the given sinks.
+func newSinkLogger(sinks ...logSink) logger {
+	return defaultLogger{sinks: sinks}
+}
+
+func (dl defaultLogger) log(lvl level, msg string) {
+	e := logEntry{time: time.Now(), level: lvl, msg: msg, fields: dl.fields}
+	for _, sink := range dl.sinks {
+		sink.write(e)
+	}
+}
+
+func (dl defaultLogger) With(f fields) logger {
+	merged := make(fields, len(dl.fields)+len(f))
+	for k, v := range dl.fields {
+		merged[k] = v
+	}
+	for k, v := range f {
+		merged[k] = v
+	}
+	return defaultLogger{sinks: dl.sinks, fields: merged}
+}
+
+func (dl defaultLogger) Debug(v ...interface{}) {
+	dl.log(levelDebug, fmt.Sprint(v...))
+}
+
+func (dl defaultLogger) Debugf(format string, v ...interface{}) {
+	dl.log(levelDebug, fmt.Sprintf(format, v...))
+}
+
+func (dl defaultLogger) Info(v ...interface{}) {
+	dl.log(levelInfo, fmt.Sprint(v...))
+}
+
+func (dl defaultLogger) Infof(format string, v ...interface{}) {
+	dl.log(levelInfo, fmt.Sprintf(format, v...))
 }
 
 func (dl defaultLogger) Notice(v ...interface{}) {
-	dl.l.Print("[notice] ", fmt.Sprint(v...))
+	dl.log(levelNotice, fmt.Sprint(v...))
 }
 
 func (dl defaultLogger) Noticef(format string, v ...interface{}) {
-	dl.l.Print("[notice] ", fmt.Sprintf(format, v...))
+	dl.log(levelNotice, fmt.Sprintf(format, v...))
+}
+
+func (dl defaultLogger) Warn(v ...interface{}) {
+	dl.log(levelWarn, fmt.Sprint(v...))
+}
+
+func (dl defaultLogger) Warnf(format string, v ...interface{}) {
+	dl.log(levelWarn, fmt.Sprintf(format, v...))
+}
+
+func (dl defaultLogger) Error(v ...interface{}) {
+	dl.log(levelError, fmt.Sprint(v...))
+}
+
+func (dl defaultLogger) Errorf(format string, v ...interface{}) {
+	dl.log(levelError, fmt.Sprintf(format, v...))
+}
+
+// defaultLogTag identifies the messages sent to syslog and journald.
+const defaultLogTag = "f5-auto-uploader"
+
+// newConfiguredLogger returns a logger writing to the sinks described in cfg,
+// or to w when no sink is configured. When verbose is true, the debug
+// messages are written to all the sinks.
+func newConfiguredLogger(w io.Writer, cfg logConfig, verbose bool) (logger, error) {
+	defaultLevel, err := parseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	if verbose {
+		defaultLevel = levelDebug
+	}
+	if len(cfg.Sinks) == 0 {
+		return newFormattedLogger(w, cfg.Format, defaultLevel)
+	}
+
+	sinks := make([]logSink, 0, len(cfg.Sinks))
+	for i, sinkCfg := range cfg.Sinks {
+		min := defaultLevel
+		if sinkCfg.Level != "" && !verbose {
+			if min, err = parseLevel(sinkCfg.Level); err != nil {
+				return nil, fmt.Errorf("log sink %d: %v", i, err)
+			}
+		}
+		tag := sinkCfg.Tag
+		if tag == "" {
+			tag = defaultLogTag
+		}
+		var sink logSink
+		switch sinkCfg.Type {
+		case "", "stderr":
+			format := sinkCfg.Format
+			if format == "" {
+				format = cfg.Format
+			}
+			sink, err = newWriterSink(w, format, min)
+		case "syslog":
+			sink, err = newSyslogSink(sinkCfg.Network, sinkCfg.Address, sinkCfg.Facility, tag, min)
+		case "journald":
+			sink = newJournaldSink(tag, min)
+		default:
+			err = fmt.Errorf("unsupported type %q", sinkCfg.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("log sink %d: %v", i, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return newSinkLogger(sinks...), nil
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"strings"
 	"testing"
 )
@@ -53,3 +54,83 @@ func TestDefaultLogger_Noticef(t *testing.T) {
 		t.Errorf("defaultLogger.Noticef(%q, %q): got %q; want %q", "%s", "test", got, want)
 	}
 }
+
+func TestDefaultLogger_Level(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger, err := newFormattedLogger(buf, "text", levelWarn)
+	if err != nil {
+		t.Fatalf("newFormattedLogger(): unexpected error %q", err.Error())
+	}
+	logger.Notice("test")
+	logger.Debugf("%s", "test")
+	if got := buf.String(); got != "" {
+		t.Errorf("defaultLogger.Notice(%q) with level warn: got %q; want %q", "test", got, "")
+	}
+	logger.Warn("test")
+	want := "[warn] test\n"
+	if got := trimDatetime(buf.String()); got != want {
+		t.Errorf("defaultLogger.Warn(%q): got %q; want %q", "test", got, want)
+	}
+}
+
+func TestDefaultLogger_With(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := newLogger(buf).With(fields{"watch": "/tmp/test"}).With(fields{"file": "/tmp/test/my file"})
+	logger.Info("test")
+	want := "[info] test file=\"/tmp/test/my file\" watch=/tmp/test\n"
+	if got := trimDatetime(buf.String()); got != want {
+		t.Errorf("defaultLogger.With().Info(%q): got %q; want %q", "test", got, want)
+	}
+}
+
+func TestDefaultLogger_JSON(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger, err := newFormattedLogger(buf, "json", levelDebug)
+	if err != nil {
+		t.Fatalf("newFormattedLogger(): unexpected error %q", err.Error())
+	}
+	logger.With(fields{"action": "update", "duration_ms": 42}).Noticef("%s", "test")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("defaultLogger.Noticef(): cannot decode %q: %v", buf.String(), err)
+	}
+	for k, want := range map[string]interface{}{
+		"level":       "notice",
+		"msg":         "test",
+		"action":      "update",
+		"duration_ms": float64(42),
+	} {
+		if got := entry[k]; got != want {
+			t.Errorf("defaultLogger.Noticef(): got %s %v; want %v", k, got, want)
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Error("defaultLogger.Noticef(): missing time")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		in   string
+		want level
+	}{
+		{"", levelInfo},
+		{"debug", levelDebug},
+		{"WARN", levelWarn},
+		{"error", levelError},
+	}
+	for _, test := range tests {
+		got, err := parseLevel(test.in)
+		if err != nil {
+			t.Errorf("parseLevel(%q): unexpected error %q", test.in, err.Error())
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseLevel(%q): got %v; want %v", test.in, got, test.want)
+		}
+	}
+	if _, err := parseLevel("verbose"); err == nil {
+		t.Errorf("parseLevel(%q): expected error, got nil", "verbose")
+	}
+}
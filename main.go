@@ -12,9 +12,11 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/e-XpertSolutions/f5-rest-client/f5"
 	"github.com/e-XpertSolutions/go-secret/secret"
@@ -29,7 +31,10 @@ const (
 
 // Print usage and exit with status 1.
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: %s\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "usage: %s [flags]\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s ctl [flags] status|pause|resume|resync\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s init [flags]\n", filepath.Base(os.Args[0]))
+	fmt.Fprintf(os.Stderr, "       %s secrets [flags] set|rotate-passphrase|verify\n", filepath.Base(os.Args[0]))
 	flag.PrintDefaults()
 	os.Exit(1)
 }
@@ -40,10 +45,12 @@ func version() {
 	os.Exit(0)
 }
 
-// Hide stderr and stout behind an io.Writer in order to ease testing.
+// Hide stderr and stout behind an io.Writer, and stdin behind an io.Reader, in
+// order to ease testing.
 var (
 	stderr io.Writer = os.Stderr
 	stdout io.Writer = os.Stdout
+	stdin  io.Reader = os.Stdin
 )
 
 // Wrap os.Exit call into a variable function in order to ease testing.
@@ -59,15 +66,6 @@ func fatal(v ...interface{}) {
 	exit(1)
 }
 
-// verbose prints to standard output (stdout) only when the verboseMode is
-// enabled. Otherwise it does nothing. The prefix "verbose:" is prepended to the
-// message. Arguments are handled in the manner of fmt.Print.
-func verbose(v ...interface{}) {
-	if *verboseMode {
-		fmt.Fprintln(stdout, "verbose:", fmt.Sprint(v...))
-	}
-}
-
 // info prints to standard output (stdout). The prefix "info:" is prepended to
 // the message. Arguments are handled in the manner of fmt.Print.
 func info(v ...interface{}) {
@@ -103,8 +101,9 @@ func initF5Client(cfg f5Config) (*f5.Client, error) {
 }
 
 // readUserCredentials reads a pair of username/passphrase from a gosecret
-// secret store.
-func readUserCredentials(path, passphrase string) (username, password string, err error) {
+// secret store. The credentials specific to target, if any, take precedence
+// over the default ones.
+func readUserCredentials(path, passphrase, target string) (username, password string, err error) {
 	if _, err = os.Stat(path); err != nil {
 		return
 	}
@@ -115,29 +114,32 @@ func readUserCredentials(path, passphrase string) (username, password string, er
 		return
 	}
 
-	var value []byte
-	value, err = store.Get("username")
-	if err != nil {
-		return
-	}
-	username = string(value)
-
-	value, err = store.Get("password")
-	if err != nil {
-		return
-	}
-	password = string(value)
-
+	username, password, _, err = lookupCredentials(store, target)
 	return
 }
 
 var (
 	configPath   = flag.String("config", "config.toml", "path to configuration file")
+	configFormat = flag.String("config-format", "", "format of configuration file: toml, yaml or json (default: guessed from the file extension)")
 	verboseMode  = flag.Bool("verbose", false, "enable verbose mode")
 	printVersion = flag.Bool("version", false, "print current version and exit")
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ctl":
+			runCtl(os.Args[2:])
+			return
+		case "init":
+			runInit(os.Args[2:])
+			return
+		case "secrets":
+			runSecrets(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Usage = usage
 	flag.Parse()
 
@@ -149,6 +151,12 @@ func main() {
 	if err != nil {
 		fatal(err)
 	}
+
+	l, err := newConfiguredLogger(os.Stderr, cfg.Log, *verboseMode)
+	if err != nil {
+		fatal("cannot configure logs: ", err)
+	}
+
 	switch cs := cfg.CredentialStorage; cs {
 	case "plain":
 		if cfg.F5.Password == "" {
@@ -161,7 +169,7 @@ func main() {
 			cfg.F5.Password = string(pass)
 		}
 	case "secret":
-		cfg.F5.User, cfg.F5.Password, err = readUserCredentials(cfg.SecretStorePath, cfg.Passphrase)
+		cfg.F5.User, cfg.F5.Password, err = readUserCredentials(cfg.SecretStorePath, cfg.Passphrase, credentialTarget(cfg.F5.URL))
 		if err != nil {
 			fatal("cannot read username/password from secret store: ", err)
 		}
@@ -176,37 +184,99 @@ func main() {
 	if !f5Client.IsActive() {
 		fatal(fmt.Sprintf("big-ip instance %q is not available at the moment", cfg.F5.URL))
 	} else {
-		verbose("big-ip instance is available and rest client has been successfully configured")
+		l.Debug("big-ip instance is available and rest client has been successfully configured")
+	}
+
+	stats.setReachable(cfg.F5.URL, true)
+	servers := newHTTPServers()
+	defer servers.stop()
+	if cfg.Metrics.Listen != "" {
+		servers.handle(cfg.Metrics.Listen, cfg.Metrics.Path, stats)
+	}
+	if cfg.Health.Listen != "" {
+		healthState.target = cfg.F5.URL
+		healthState.maxRetryQueue = cfg.Health.MaxRetryQueue
+		servers.handle(cfg.Health.Listen, "/healthz", http.HandlerFunc(healthState.serveHealthz))
+		servers.handle(cfg.Health.Listen, "/readyz", http.HandlerFunc(healthState.serveReadyz))
+	}
+	ctl := &controller{}
+	if cfg.Control.Listen != "" {
+		servers.handle(cfg.Control.Listen, "/v1/", ctl.handler())
+	}
+	var monitorStop chan struct{}
+	if cfg.Metrics.Listen != "" || cfg.Health.Listen != "" {
+		monitorStop = make(chan struct{})
+		defer func() { close(monitorStop) }()
+		go monitorReachability(f5Client, cfg.F5.URL, cfg.Metrics.ReachabilityInterval.Duration, monitorStop)
 	}
+	if err := servers.start(l); err != nil {
+		l.Error("cannot start http server: ", err)
+		return
+	}
+
+	cache, err := loadHashCache(cfg.CacheFile)
+	if err != nil {
+		l.Error(err)
+		return
+	}
+	audit, err := openAuditLog(cfg.Audit.File, int64(cfg.Audit.MaxSizeMB)<<20, cfg.Audit.MaxBackups)
+	if err != nil {
+		l.Error(err)
+		return
+	}
+	defer audit.close()
+	notify, err := newNotifiers(cfg.Notify, l)
+	if err != nil {
+		l.Error(err)
+		return
+	}
+	defer notify.close()
+	env := syncEnv{
+		f5Client: f5Client,
+		target:   cfg.F5.URL,
+		l:        l,
+		cache:    cache,
+		audit:    audit,
+		notify:   notify,
+		uploader: newUploader(cfg.Upload),
+	}
+	ws := newWatchSet(env, ctl)
+	defer ws.stopAll()
+	if err := ws.apply(env, cfg.Watch, cfg.ILX); err != nil {
+		l.Error(err)
+		return
+	}
+	healthState.setStarted()
 
-	l := newLogger(os.Stderr)
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Kill, os.Interrupt, syscall.SIGHUP)
 
-	var routines []*watchRoutine
-	defer func() {
-		for i, r := range routines {
-			l.Noticef("stopping routine %d", i)
-			if err := r.stop(); err != nil {
-				l.Errorf("cannot stop routine %d: %v", i, err)
-			}
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			break
 		}
-	}()
-	for _, watchCfg := range cfg.Watch {
-		if err := scanDir(watchCfg.Dir, watchCfg.Exclude, f5Client); err != nil {
-			l.Errorf("cannot scan directory %q: %v", watchCfg.Dir, err)
-			return
-		}
-		routine, err := watchDir(f5Client, l, watchCfg)
+		l.Noticef("reloading configuration file %q", *configPath)
+		newCfg, err := reloadConfig(*configPath, cfg, ws)
 		if err != nil {
-			l.Error(err)
-			return
+			l.Error("cannot reload configuration: ", err)
 		}
-		routines = append(routines, routine)
+		if newCfg == nil {
+			continue
+		}
+		restartMonitor := newCfg.Metrics.ReachabilityInterval != cfg.Metrics.ReachabilityInterval
+		if ws.env.f5Client != f5Client {
+			f5Client = ws.env.f5Client
+			stats.setReachable(newCfg.F5.URL, true)
+			healthState.setTarget(newCfg.F5.URL)
+			restartMonitor = true
+		}
+		if restartMonitor && monitorStop != nil {
+			close(monitorStop)
+			monitorStop = make(chan struct{})
+			go monitorReachability(f5Client, newCfg.F5.URL, newCfg.Metrics.ReachabilityInterval.Duration, monitorStop)
+		}
+		cfg = newCfg
 	}
 
-	sig := make(chan os.Signal, 2)
-	signal.Notify(sig, os.Kill, os.Interrupt)
-
-	<-sig
-
-	info("bye.")
+	l.Info("bye.")
 }
@@ -33,41 +33,6 @@ func TestFatal(t *testing.T) {
 	}
 }
 
-func TestVerbose(t *testing.T) {
-	t.Run("Enabled", testVerboseWhenEnabled)
-	t.Run("Disabled", testVerboseWhenDisabled)
-}
-
-func testVerboseWhenEnabled(t *testing.T) {
-	b := true
-	verboseMode = &b
-
-	stdoutBuf := new(bytes.Buffer)
-	stdout = stdoutBuf
-
-	verbose("test")
-
-	want := "verbose: test\n"
-	if got := stdoutBuf.String(); got != want {
-		t.Errorf("verbose(%q): got %q; want %q", "test", got, want)
-	}
-}
-
-func testVerboseWhenDisabled(t *testing.T) {
-	var b bool
-	verboseMode = &b
-
-	stdoutBuf := new(bytes.Buffer)
-	stdout = stdoutBuf
-
-	verbose("test")
-
-	want := ""
-	if got := stdoutBuf.String(); got != want {
-		t.Errorf("verbose(%q): got %q; want %q", "test", got, want)
-	}
-}
-
 func TestInfo(t *testing.T) {
 	stdoutBuf := new(bytes.Buffer)
 	stdout = stdoutBuf
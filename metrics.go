@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/e-XpertSolutions/f5-rest-client/f5"
+)
+
+// defaultReachabilityInterval is how often the BigIP reachability is checked
+// when no interval is configured.
+const defaultReachabilityInterval = 30 * time.Second
+
+// txDurationBuckets are the upper bounds, in seconds, of the buckets of the
+// transaction latency histogram.
+var txDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram is a minimal Prometheus histogram.
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(txDurationBuckets))
+	}
+	for i, bound := range txDurationBuckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// metrics collects the statistics exposed in the Prometheus text format.
+type metrics struct {
+	mu              sync.Mutex
+	changes         map[[2]string]uint64 // by action and result
+	txDuration      histogram
+	lastWatchSync   map[string]time.Time
+	lastTargetSync  map[string]time.Time
+	watcherErrors   map[string]uint64
+	hookRuns        map[[3]string]uint64 // by watch, hook and result
+	guardViolations map[[2]string]uint64 // by watch and reason
+	reachable       map[string]bool
+	retryQueues     map[string]*retryQueue
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		changes:         make(map[[2]string]uint64),
+		lastWatchSync:   make(map[string]time.Time),
+		lastTargetSync:  make(map[string]time.Time),
+		watcherErrors:   make(map[string]uint64),
+		hookRuns:        make(map[[3]string]uint64),
+		guardViolations: make(map[[2]string]uint64),
+		reachable:       make(map[string]bool),
+		retryQueues:     make(map[string]*retryQueue),
+	}
+}
+
+// stats holds the metrics of the running process.
+var stats = newMetrics()
+
+// observeChange records the outcome of a change: action is either "create",
+// "update" or "delete".
+func (m *metrics) observeChange(action string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.mu.Lock()
+	m.changes[[2]string{action, result}]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) observeTransaction(d time.Duration) {
+	m.mu.Lock()
+	m.txDuration.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+// observeSync records a successful synchronisation of watch with target.
+func (m *metrics) observeSync(watch, target string) {
+	now := time.Now()
+	m.mu.Lock()
+	m.lastWatchSync[watch] = now
+	m.lastTargetSync[target] = now
+	m.mu.Unlock()
+}
+
+func (m *metrics) observeWatcherError(watch string) {
+	m.mu.Lock()
+	m.watcherErrors[watch]++
+	m.mu.Unlock()
+}
+
+// observeHook records the result of a hook command: hook is either "pre" or
+// "post".
+func (m *metrics) observeHook(watch, hook string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.mu.Lock()
+	m.hookRuns[[3]string{watch, hook, result}]++
+	m.mu.Unlock()
+}
+
+// observeGuardViolation records a file refused by the guardrails of watch.
+func (m *metrics) observeGuardViolation(watch, reason string) {
+	m.mu.Lock()
+	m.guardViolations[[2]string{watch, reason}]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) setReachable(target string, up bool) {
+	m.mu.Lock()
+	m.reachable[target] = up
+	m.mu.Unlock()
+}
+
+// isReachable reports whether target was reachable when last checked.
+func (m *metrics) isReachable(target string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reachable[target]
+}
+
+func (m *metrics) registerRetryQueue(watch string, q *retryQueue) {
+	m.mu.Lock()
+	m.retryQueues[watch] = q
+	m.mu.Unlock()
+}
+
+func (m *metrics) unregisterRetryQueue(watch string) {
+	m.mu.Lock()
+	delete(m.retryQueues, watch)
+	m.mu.Unlock()
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.writeTo(w)
+}
+
+// writeTo writes all the metrics to w in the Prometheus text format.
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "f5_auto_uploader_changes_total", "counter", "Number of changes applied to the BigIP by action and result.")
+	keys := make([][2]string, 0, len(m.changes))
+	for k := range m.changes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "f5_auto_uploader_changes_total{action=%s,result=%s} %d\n",
+			quoteLabel(k[0]), quoteLabel(k[1]), m.changes[k])
+	}
+
+	writeHeader(w, "f5_auto_uploader_transaction_duration_seconds", "histogram", "Latency of the BigIP transactions.")
+	var cumulative uint64
+	for i, bound := range txDurationBuckets {
+		if m.txDuration.counts != nil {
+			cumulative += m.txDuration.counts[i]
+		}
+		fmt.Fprintf(w, "f5_auto_uploader_transaction_duration_seconds_bucket{le=%s} %d\n",
+			quoteLabel(formatFloat(bound)), cumulative)
+	}
+	fmt.Fprintf(w, "f5_auto_uploader_transaction_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.txDuration.count)
+	fmt.Fprintf(w, "f5_auto_uploader_transaction_duration_seconds_sum %s\n", formatFloat(m.txDuration.sum))
+	fmt.Fprintf(w, "f5_auto_uploader_transaction_duration_seconds_count %d\n", m.txDuration.count)
+
+	writeHeader(w, "f5_auto_uploader_retry_queue_depth", "gauge", "Number of changes waiting to be retried.")
+	for _, watch := range sortedKeys(m.retryQueues) {
+		fmt.Fprintf(w, "f5_auto_uploader_retry_queue_depth{watch=%s} %d\n",
+			quoteLabel(watch), m.retryQueues[watch].len())
+	}
+
+	writeHeader(w, "f5_auto_uploader_last_sync_timestamp_seconds", "gauge", "Time of the last successful synchronisation per watch.")
+	for _, watch := range sortedKeys(m.lastWatchSync) {
+		fmt.Fprintf(w, "f5_auto_uploader_last_sync_timestamp_seconds{watch=%s} %d\n",
+			quoteLabel(watch), m.lastWatchSync[watch].Unix())
+	}
+
+	writeHeader(w, "f5_auto_uploader_target_last_sync_timestamp_seconds", "gauge", "Time of the last successful synchronisation per BigIP.")
+	for _, target := range sortedKeys(m.lastTargetSync) {
+		fmt.Fprintf(w, "f5_auto_uploader_target_last_sync_timestamp_seconds{target=%s} %d\n",
+			quoteLabel(target), m.lastTargetSync[target].Unix())
+	}
+
+	writeHeader(w, "f5_auto_uploader_watcher_errors_total", "counter", "Number of errors reported by the file system watchers.")
+	for _, watch := range sortedKeys(m.watcherErrors) {
+		fmt.Fprintf(w, "f5_auto_uploader_watcher_errors_total{watch=%s} %d\n",
+			quoteLabel(watch), m.watcherErrors[watch])
+	}
+
+	writeHeader(w, "f5_auto_uploader_hook_runs_total", "counter", "Number of hook commands run by watch, hook and result.")
+	hookKeys := make([][3]string, 0, len(m.hookRuns))
+	for k := range m.hookRuns {
+		hookKeys = append(hookKeys, k)
+	}
+	sort.Slice(hookKeys, func(i, j int) bool {
+		for n := range hookKeys[i] {
+			if hookKeys[i][n] != hookKeys[j][n] {
+				return hookKeys[i][n] < hookKeys[j][n]
+			}
+		}
+		return false
+	})
+	for _, k := range hookKeys {
+		fmt.Fprintf(w, "f5_auto_uploader_hook_runs_total{watch=%s,hook=%s,result=%s} %d\n",
+			quoteLabel(k[0]), quoteLabel(k[1]), quoteLabel(k[2]), m.hookRuns[k])
+	}
+
+	writeHeader(w, "f5_auto_uploader_guard_violations_total", "counter", "Number of files refused by the guardrails by watch and reason.")
+	guardKeys := make([][2]string, 0, len(m.guardViolations))
+	for k := range m.guardViolations {
+		guardKeys = append(guardKeys, k)
+	}
+	sort.Slice(guardKeys, func(i, j int) bool {
+		if guardKeys[i][0] != guardKeys[j][0] {
+			return guardKeys[i][0] < guardKeys[j][0]
+		}
+		return guardKeys[i][1] < guardKeys[j][1]
+	})
+	for _, k := range guardKeys {
+		fmt.Fprintf(w, "f5_auto_uploader_guard_violations_total{watch=%s,reason=%s} %d\n",
+			quoteLabel(k[0]), quoteLabel(k[1]), m.guardViolations[k])
+	}
+
+	writeHeader(w, "f5_auto_uploader_bigip_up", "gauge", "Whether the BigIP is reachable (1) or not (0).")
+	for _, target := range sortedKeys(m.reachable) {
+		var up int
+		if m.reachable[target] {
+			up = 1
+		}
+		fmt.Fprintf(w, "f5_auto_uploader_bigip_up{target=%s} %d\n", quoteLabel(target), up)
+	}
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// quoteLabel quotes a label value as expected by the Prometheus text format.
+func quoteLabel(v string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(v) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a map indexed by strings, in order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]time.Time:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]uint64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]bool:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*retryQueue:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// monitorReachability periodically checks whether the BigIP is reachable and
+// records the result until stopCh is closed.
+func monitorReachability(f5Client *f5.Client, target string, interval time.Duration, stopCh <-chan struct{}) {
+	if interval <= 0 {
+		interval = defaultReachabilityInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		stats.setReachable(target, f5Client.IsActive())
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	fsnotify "gopkg.in/fsnotify.v1"
+)
+
+func TestMetrics_WriteTo(t *testing.T) {
+	m := newMetrics()
+	m.observeChange("create", nil)
+	m.observeChange("create", nil)
+	m.observeChange("update", errors.New("some error"))
+	m.observeTransaction(300 * time.Millisecond)
+	m.observeWatcherError("/tmp/test")
+	m.observeHook("/tmp/test", "post", errors.New("some error"))
+	m.setReachable("https://bigip", true)
+	q := newRetryQueue()
+	q.add(watchEvent{Name: "/tmp/test/index.html", Op: fsnotify.Write})
+	m.registerRetryQueue("/tmp/test", q)
+
+	buf := new(bytes.Buffer)
+	m.writeTo(buf)
+	out := buf.String()
+
+	for _, want := range []string{
+		`f5_auto_uploader_changes_total{action="create",result="success"} 2` + "\n",
+		`f5_auto_uploader_changes_total{action="update",result="failure"} 1` + "\n",
+		`f5_auto_uploader_transaction_duration_seconds_bucket{le="0.25"} 0` + "\n",
+		`f5_auto_uploader_transaction_duration_seconds_bucket{le="0.5"} 1` + "\n",
+		`f5_auto_uploader_transaction_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		`f5_auto_uploader_transaction_duration_seconds_count 1` + "\n",
+		`f5_auto_uploader_retry_queue_depth{watch="/tmp/test"} 1` + "\n",
+		`f5_auto_uploader_watcher_errors_total{watch="/tmp/test"} 1` + "\n",
+		`f5_auto_uploader_hook_runs_total{watch="/tmp/test",hook="post",result="failure"} 1` + "\n",
+		`f5_auto_uploader_bigip_up{target="https://bigip"} 1` + "\n",
+		"# TYPE f5_auto_uploader_transaction_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics.writeTo(): output does not contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestQuoteLabel(t *testing.T) {
+	in := "C:\\dir \"quoted\"\n"
+	want := `"C:\\dir \"quoted\"\n"`
+	if got := quoteLabel(in); got != want {
+		t.Errorf("quoteLabel(%q): got %q; want %q", in, got, want)
+	}
+}
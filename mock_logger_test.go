@@ -10,16 +10,31 @@ import (
 // discardLogger does not write any log.
 type discardLogger struct{}
 
-func (dl discardLogger) Error(...interface{})           {}
-func (dl discardLogger) Errorf(string, ...interface{})  {}
+func (dl discardLogger) Debug(...interface{})           {}
+func (dl discardLogger) Debugf(string, ...interface{})  {}
+func (dl discardLogger) Info(...interface{})            {}
+func (dl discardLogger) Infof(string, ...interface{})   {}
 func (dl discardLogger) Notice(...interface{})          {}
 func (dl discardLogger) Noticef(string, ...interface{}) {}
+func (dl discardLogger) Warn(...interface{})            {}
+func (dl discardLogger) Warnf(string, ...interface{})   {}
+func (dl discardLogger) Error(...interface{})           {}
+func (dl discardLogger) Errorf(string, ...interface{})  {}
+func (dl discardLogger) With(fields) logger             { return dl }
 
 // bufferedLogger does not write any log but keep them into a buffer instead.
 type bufferedLogger struct {
 	errBuf, noticeBuf string
 }
 
+func (bl *bufferedLogger) Debug(...interface{})          {}
+func (bl *bufferedLogger) Debugf(string, ...interface{}) {}
+func (bl *bufferedLogger) Info(...interface{})           {}
+func (bl *bufferedLogger) Infof(string, ...interface{})  {}
+func (bl *bufferedLogger) Warn(...interface{})           {}
+func (bl *bufferedLogger) Warnf(string, ...interface{})  {}
+func (bl *bufferedLogger) With(fields) logger            { return bl }
+
 func (bl *bufferedLogger) Error(v ...interface{}) {
 	bl.errBuf = fmt.Sprint(v...)
 }
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"text/template"
+	"time"
+)
+
+// Kinds of notifications.
+const (
+	notifyDeployed = "deployed" // changes have been applied onto the BigIP
+	notifyFailed   = "failed"   // changes have been given up after several attempts
+)
+
+const (
+	defaultNotifyTimeout    = 10 * time.Second
+	defaultNotifyMaxRetries = 3
+
+	// notifyRetryDelay is the delay before the first retry of a delivery,
+	// doubled after each attempt.
+	notifyRetryDelay = time.Second
+
+	// notifyQueueSize is the number of notifications waiting for delivery
+	// above which new notifications are dropped.
+	notifyQueueSize = 64
+)
+
+// defaultNotifyTemplate is the template of the message sent to Slack and
+// Teams.
+const defaultNotifyTemplate = `{{if eq .Event "deployed"}}{{len .Changes}} change(s) deployed{{else}}{{len .Changes}} change(s) failed{{end}} from {{.Watch}} to {{.Target}}
+{{range .Changes}}- {{.Action}} {{.Object}}{{if .Error}}: {{.Error}}{{end}}
+{{end}}`
+
+// notification is a batch of changes of the same kind sent to the webhooks.
+type notification struct {
+	Event   string        `json:"event"`
+	Target  string        `json:"target"`
+	Watch   string        `json:"watch"`
+	Time    time.Time     `json:"timestamp"`
+	Changes []auditRecord `json:"changes"`
+}
+
+// notifier delivers notifications to a webhook. Notifications are delivered
+// in the background, at most once per MinInterval; the notifications queued
+// in the meantime are merged together.
+type notifier struct {
+	cfg    notifyConfig
+	tmpl   *template.Template // nil for generic webhooks without template
+	events map[string]bool
+	client *http.Client
+	l      logger
+	queue  chan notification
+	done   chan struct{}
+	last   time.Time
+}
+
+func newNotifier(cfg notifyConfig, l logger) (*notifier, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("missing webhook url")
+	}
+	text := cfg.Template
+	switch cfg.Type {
+	case "slack", "teams":
+		if text == "" {
+			text = defaultNotifyTemplate
+		}
+	case "", "generic":
+		cfg.Type = "generic"
+	default:
+		return nil, fmt.Errorf("unsupported notification type %q", cfg.Type)
+	}
+	n := &notifier{
+		cfg:    cfg,
+		events: make(map[string]bool),
+		l:      l.With(fields{"webhook": cfg.Type}),
+		queue:  make(chan notification, notifyQueueSize),
+		done:   make(chan struct{}),
+	}
+	if text != "" {
+		tmpl, err := template.New("notify").Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				data, err := json.Marshal(v)
+				return string(data), err
+			},
+		}).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid notification template: %v", err)
+		}
+		n.tmpl = tmpl
+	}
+	if len(cfg.Events) == 0 {
+		cfg.Events = []string{notifyDeployed, notifyFailed}
+	}
+	for _, event := range cfg.Events {
+		if event != notifyDeployed && event != notifyFailed {
+			return nil, fmt.Errorf("unsupported notification event %q", event)
+		}
+		n.events[event] = true
+	}
+	if n.cfg.Timeout.Duration <= 0 {
+		n.cfg.Timeout.Duration = defaultNotifyTimeout
+	}
+	if n.cfg.MaxRetries == 0 {
+		n.cfg.MaxRetries = defaultNotifyMaxRetries
+	} else if n.cfg.MaxRetries < 0 {
+		n.cfg.MaxRetries = 0
+	}
+	n.client = &http.Client{Timeout: n.cfg.Timeout.Duration}
+	go n.run()
+	return n, nil
+}
+
+// send queues nt for delivery, unless the webhook is not interested in it.
+func (n *notifier) send(nt notification) {
+	if !n.events[nt.Event] {
+		return
+	}
+	// Changes are copied as they are shared with the other webhooks.
+	nt.Changes = append([]auditRecord(nil), nt.Changes...)
+	select {
+	case n.queue <- nt:
+	default:
+		n.l.Warnf("notification queue is full, dropping %q notification", nt.Event)
+	}
+}
+
+func (n *notifier) run() {
+	defer close(n.done)
+	for nt := range n.queue {
+		if wait := n.cfg.MinInterval.Duration - time.Since(n.last); wait > 0 {
+			time.Sleep(wait)
+		}
+		batch := []notification{nt}
+	drain:
+		for {
+			select {
+			case next, ok := <-n.queue:
+				if !ok {
+					break drain
+				}
+				batch = mergeNotification(batch, next)
+			default:
+				break drain
+			}
+		}
+		for _, nt := range batch {
+			if err := n.deliver(nt); err != nil {
+				n.l.Errorf("cannot deliver %q notification: %v", nt.Event, err)
+			}
+		}
+		n.last = time.Now()
+	}
+}
+
+// mergeNotification appends the changes of nt to the notification of the
+// same kind in batch, or appends nt to batch if there is none.
+func mergeNotification(batch []notification, nt notification) []notification {
+	for i := range batch {
+		if batch[i].Event == nt.Event && batch[i].Watch == nt.Watch && batch[i].Target == nt.Target {
+			batch[i].Changes = append(batch[i].Changes, nt.Changes...)
+			batch[i].Time = nt.Time
+			return batch
+		}
+	}
+	return append(batch, nt)
+}
+
+// payload returns the body of the request sent to the webhook for nt.
+func (n *notifier) payload(nt notification) ([]byte, error) {
+	if n.tmpl == nil {
+		return json.Marshal(nt)
+	}
+	var buf bytes.Buffer
+	if err := n.tmpl.Execute(&buf, nt); err != nil {
+		return nil, fmt.Errorf("cannot execute notification template: %v", err)
+	}
+	if n.cfg.Type == "generic" {
+		return buf.Bytes(), nil
+	}
+	// Slack and Teams incoming webhooks both accept a simple text message.
+	return json.Marshal(map[string]string{"text": buf.String()})
+}
+
+// deliver posts nt to the webhook, retrying with an exponential backoff on
+// network errors and server errors.
+func (n *notifier) deliver(nt notification) error {
+	body, err := n.payload(nt)
+	if err != nil {
+		return err
+	}
+	delay := notifyRetryDelay
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = n.post(body)
+		if err == nil || !retry || attempt >= n.cfg.MaxRetries {
+			return err
+		}
+		n.l.Debugf("cannot deliver %q notification, retrying in %v: %v", nt.Event, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post sends body to the webhook. It reports whether the request may be
+// retried on failure.
+func (n *notifier) post(body []byte) (bool, error) {
+	resp, err := n.client.Post(n.cfg.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("unexpected status %q", resp.Status)
+}
+
+// close waits for the queued notifications to be delivered.
+func (n *notifier) close() {
+	close(n.queue)
+	<-n.done
+}
+
+// notifiers fans notifications out to several webhooks.
+type notifiers []*notifier
+
+func newNotifiers(cfgs []notifyConfig, l logger) (notifiers, error) {
+	var ns notifiers
+	for i, cfg := range cfgs {
+		n, err := newNotifier(cfg, l)
+		if err != nil {
+			ns.close()
+			return nil, fmt.Errorf("invalid notify configuration #%d: %v", i+1, err)
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+func (ns notifiers) send(nt notification) {
+	if len(nt.Changes) == 0 {
+		return
+	}
+	sort.SliceStable(nt.Changes, func(i, j int) bool { return nt.Changes[i].Object < nt.Changes[j].Object })
+	for _, n := range ns {
+		n.send(nt)
+	}
+}
+
+func (ns notifiers) close() {
+	for _, n := range ns {
+		n.close()
+	}
+}
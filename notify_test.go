@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRecorder is a webhook recording the body of the requests it
+// receives. The first failures requests are answered with an error.
+type webhookRecorder struct {
+	mu       sync.Mutex
+	failures int
+	bodies   []string
+}
+
+func (wr *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	if wr.failures > 0 {
+		wr.failures--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	wr.bodies = append(wr.bodies, string(body))
+}
+
+func TestNotifierSlack(t *testing.T) {
+	wr := &webhookRecorder{failures: 1}
+	ts := httptest.NewServer(wr)
+	defer ts.Close()
+
+	n, err := newNotifier(notifyConfig{Type: "slack", URL: ts.URL}, discardLogger{})
+	if err != nil {
+		t.Fatalf("newNotifier: unexpected error %q", err.Error())
+	}
+	n.send(notification{
+		Event:   notifyDeployed,
+		Target:  "https://bigip",
+		Watch:   "/tmp/test",
+		Changes: []auditRecord{{Object: "index.html", Action: "update"}},
+	})
+	n.close()
+
+	if len(wr.bodies) != 1 {
+		t.Fatalf("notifier: got %d requests; want 1", len(wr.bodies))
+	}
+	var payload struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal([]byte(wr.bodies[0]), &payload); err != nil {
+		t.Fatalf("notifier: invalid payload %q: %v", wr.bodies[0], err)
+	}
+	want := "1 change(s) deployed from /tmp/test to https://bigip\n- update index.html\n"
+	if payload.Text != want {
+		t.Errorf("notifier: got %q; want %q", payload.Text, want)
+	}
+}
+
+func TestNotifierBatching(t *testing.T) {
+	wr := &webhookRecorder{}
+	ts := httptest.NewServer(wr)
+	defer ts.Close()
+
+	cfg := notifyConfig{
+		URL:         ts.URL,
+		Events:      []string{notifyFailed},
+		Template:    `{{range .Changes}}{{.Object}} {{end}}`,
+		MinInterval: duration{time.Hour},
+	}
+	n, err := newNotifier(cfg, discardLogger{})
+	if err != nil {
+		t.Fatalf("newNotifier: unexpected error %q", err.Error())
+	}
+	// Pretend a notification was just sent so the next ones are held and
+	// merged until close.
+	n.last = time.Now().Add(-time.Hour + 100*time.Millisecond)
+	for _, name := range []string{"a.html", "b.html"} {
+		n.send(notification{Event: notifyFailed, Changes: []auditRecord{{Object: name}}})
+	}
+	n.send(notification{Event: notifyDeployed, Changes: []auditRecord{{Object: "c.html"}}})
+	n.close()
+
+	if got, want := strings.Join(wr.bodies, "|"), "a.html b.html "; got != want {
+		t.Errorf("notifier: got %q; want %q", got, want)
+	}
+}
+
+func TestNewNotifierErrors(t *testing.T) {
+	cfgs := []notifyConfig{
+		{Type: "slack"},
+		{Type: "irc", URL: "http://localhost"},
+		{URL: "http://localhost", Events: []string{"deleted"}},
+		{URL: "http://localhost", Template: "{{.Event"},
+	}
+	for _, cfg := range cfgs {
+		if _, err := newNotifier(cfg, discardLogger{}); err == nil {
+			t.Errorf("newNotifier(%+v): expected error, got nil", cfg)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// reloadConfig reads the configuration file located at path again and applies
+// the changes made to the watches and to the BigIP onto ws. Only the affected
+// watches are restarted. The other settings require the service to be
+// restarted and are ignored.
+//
+// The new configuration is returned as soon as it has been read successfully,
+// even though some of the watches may have failed to start.
+func reloadConfig(path string, old *config, ws *watchSet) (*config, error) {
+	cfg, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	switch cs := cfg.CredentialStorage; cs {
+	case "plain":
+		if cfg.F5.Password == "" {
+			// The password has been read from the terminal at startup.
+			cfg.F5.Password = old.F5.Password
+		}
+	case "secret":
+		cfg.F5.User, cfg.F5.Password, err = readUserCredentials(cfg.SecretStorePath, cfg.Passphrase, credentialTarget(cfg.F5.URL))
+		if err != nil {
+			return nil, errors.New("cannot read username/password from secret store: " + err.Error())
+		}
+	default:
+		return nil, fmt.Errorf("unsupported credential storage %q", cs)
+	}
+
+	l := ws.env.l
+	env := ws.env
+	if cfg.F5 != old.F5 {
+		f5Client, err := initF5Client(cfg.F5)
+		if err != nil {
+			return nil, err
+		}
+		if !f5Client.IsActive() {
+			return nil, fmt.Errorf("big-ip instance %q is not available at the moment", cfg.F5.URL)
+		}
+		l.Noticef("switching to big-ip instance %q", cfg.F5.URL)
+		env.f5Client = f5Client
+		env.target = cfg.F5.URL
+	}
+
+	for _, s := range []struct {
+		name    string
+		changed bool
+	}{
+		{"cache_file", cfg.CacheFile != old.CacheFile},
+		{"log", !reflect.DeepEqual(cfg.Log, old.Log)},
+		// The reachability interval is applied by the caller.
+		{"metrics", cfg.Metrics.Listen != old.Metrics.Listen || cfg.Metrics.Path != old.Metrics.Path},
+		{"health", !reflect.DeepEqual(cfg.Health, old.Health)},
+		{"control", !reflect.DeepEqual(cfg.Control, old.Control)},
+		{"audit", !reflect.DeepEqual(cfg.Audit, old.Audit)},
+		{"notify", !reflect.DeepEqual(cfg.Notify, old.Notify)},
+		{"upload", cfg.Upload != old.Upload},
+	} {
+		if s.changed {
+			l.Warnf("changes made to %q are ignored until the service is restarted", s.name)
+		}
+	}
+
+	return cfg, ws.apply(env, cfg.Watch, cfg.ILX)
+}
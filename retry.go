@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// retryDelay is the delay before the first retry of a failed change. It
+	// doubles with each subsequent attempt.
+	retryDelay = 5 * time.Second
+
+	// maxRetryAttempts is the number of times a failed change is retried
+	// before giving up.
+	maxRetryAttempts = 5
+
+	// retryCheckInterval is how often the retry queue is checked for changes
+	// that are due.
+	retryCheckInterval = time.Second
+)
+
+type retryEntry struct {
+	event    watchEvent
+	attempts int
+	next     time.Time
+}
+
+// retryQueue holds the changes that failed and have to be applied again
+// later. There is at most one entry per file.
+type retryQueue struct {
+	mu      sync.Mutex
+	entries map[string]*retryEntry
+}
+
+func newRetryQueue() *retryQueue {
+	return &retryQueue{entries: make(map[string]*retryEntry)}
+}
+
+// add schedules a new attempt for e. It returns false when the maximum number
+// of attempts has been reached, in which case e is dropped from the queue.
+func (q *retryQueue) add(e watchEvent) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry, ok := q.entries[e.Name]
+	if !ok {
+		entry = &retryEntry{}
+		q.entries[e.Name] = entry
+	}
+	entry.event = e
+	entry.attempts++
+	if entry.attempts > maxRetryAttempts {
+		delete(q.entries, e.Name)
+		return false
+	}
+	entry.next = time.Now().Add(retryDelay << uint(entry.attempts-1))
+	return true
+}
+
+// done removes name from the queue.
+func (q *retryQueue) done(name string) {
+	q.mu.Lock()
+	delete(q.entries, name)
+	q.mu.Unlock()
+}
+
+// due returns the events whose next attempt is due at the given time, sorted
+// by name. They are kept in the queue until done is called.
+func (q *retryQueue) due(now time.Time) []watchEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var events []watchEvent
+	for _, entry := range q.entries {
+		if !entry.next.After(now) {
+			events = append(events, entry.event)
+			// Prevent the same event from being returned again until it is
+			// either done or re-added.
+			entry.next = now.Add(retryDelay << uint(maxRetryAttempts))
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	return events
+}
+
+// len returns the number of changes waiting to be retried.
+func (q *retryQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	fsnotify "gopkg.in/fsnotify.v1"
+)
+
+func TestRetryQueue(t *testing.T) {
+	q := newRetryQueue()
+	e := watchEvent{Name: "/tmp/test/index.html", Op: fsnotify.Write}
+
+	if !q.add(e) {
+		t.Fatal("retryQueue.add(): got false; want true")
+	}
+	if got := q.len(); got != 1 {
+		t.Errorf("retryQueue.len(): got %d; want %d", got, 1)
+	}
+	if got := q.due(time.Now()); len(got) != 0 {
+		t.Errorf("retryQueue.due(now): got %d events; want %d", len(got), 0)
+	}
+	got := q.due(time.Now().Add(retryDelay))
+	if len(got) != 1 || got[0] != e {
+		t.Fatalf("retryQueue.due(now+retryDelay): got %v; want [%v]", got, e)
+	}
+	if got := q.due(time.Now().Add(retryDelay)); len(got) != 0 {
+		t.Errorf("retryQueue.due(now+retryDelay): got %d events on second call; want %d", len(got), 0)
+	}
+
+	q.done(e.Name)
+	if got := q.len(); got != 0 {
+		t.Errorf("retryQueue.len(): got %d after done; want %d", got, 0)
+	}
+}
+
+func TestRetryQueue_GiveUp(t *testing.T) {
+	q := newRetryQueue()
+	e := watchEvent{Name: "/tmp/test/index.html", Op: fsnotify.Write}
+	for i := 0; i < maxRetryAttempts; i++ {
+		if !q.add(e) {
+			t.Fatalf("retryQueue.add(): got false at attempt %d; want true", i+1)
+		}
+	}
+	if q.add(e) {
+		t.Error("retryQueue.add(): got true after max attempts; want false")
+	}
+	if got := q.len(); got != 0 {
+		t.Errorf("retryQueue.len(): got %d; want %d", got, 0)
+	}
+}
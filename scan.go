@@ -4,62 +4,199 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
-
-	"github.com/e-XpertSolutions/f5-rest-client/f5"
-	"github.com/e-XpertSolutions/f5-rest-client/f5/ltm"
+	"sync"
+	"time"
 )
 
-func scanDir(dir string, excl []string, f5Client *f5.Client) error {
-	ltmClient := ltm.New(f5Client)
-	ifilesList, err := ltmClient.IFile().ListAll()
+// defaultScanWorkers is the number of files compared concurrently with their
+// remote counterparts during a scan when no concurrency is configured.
+const defaultScanWorkers = 8
+
+// scanCandidate is a file of the watched directory that may have to be
+// uploaded.
+type scanCandidate struct {
+	fi     os.FileInfo
+	path   string
+	exists bool // on the BigIP
+
+	// Result of the comparison with the remote object.
+	same           bool
+	remoteChecksum string
+	err            error
+}
+
+// runPool calls fn for each integer in [0, n) from at most workers
+// goroutines, defaultScanWorkers when workers is not positive, and waits for
+// all the calls to return.
+func runPool(n, workers int, fn func(i int)) {
+	if workers <= 0 {
+		workers = defaultScanWorkers
+	}
+	if workers > n {
+		workers = n
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+func scanDir(s *syncer) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	existingFiles, err := s.h.List(s.f5Client)
 	if err != nil {
-		return errors.New("cannot retrieve list of existing ifiles: " + err.Error())
+		return errors.New("cannot retrieve list of existing objects: " + err.Error())
 	}
-	existingFiles := make(map[string]struct{})
-	for _, item := range ifilesList.Items {
-		existingFiles[filepath.Base(item.FileName)] = struct{}{}
+	// The checksums are fetched at once rather than object by object, the
+	// latter being used as a fallback.
+	remoteChecksums, err := s.h.Checksums(s.f5Client)
+	if err != nil {
+		s.l.Warnf("cannot retrieve checksums of existing objects, fetching them one by one: %v", err)
 	}
-	fis, err := ioutil.ReadDir(dir)
+	fis, err := ioutil.ReadDir(s.cfg.Dir)
 	if err != nil {
-		return fmt.Errorf("cannot read content of directory %q: %v", dir, err)
+		return fmt.Errorf("cannot read content of directory %q: %v", s.cfg.Dir, err)
+	}
+	var candidates []*scanCandidate
+	for _, fi := range fis {
+		path := filepath.Join(s.cfg.Dir, fi.Name())
+		if fi.IsDir() || !fi.Mode().IsRegular() || s.filter.skip(path, false) {
+			continue
+		}
+		if err := s.checkGuard(path); err != nil {
+			if _, ok := err.(*guardError); !ok {
+				s.l.Errorf("skipping %q: %v", path, err)
+			}
+			continue
+		}
+		if err := s.h.Validate(fi.Name(), path); err != nil {
+			s.l.Errorf("skipping %q: %v", path, err)
+			continue
+		}
+		_, exists := existingFiles[fi.Name()]
+		candidates = append(candidates, &scanCandidate{fi: fi, path: path, exists: exists})
 	}
-	tx, err := f5Client.Begin()
+
+	// The local and remote checksums of the existing objects are compared
+	// concurrently, the changes are then applied in order.
+	runPool(len(candidates), s.cfg.ScanWorkers, func(i int) {
+		c := candidates[i]
+		if !c.exists {
+			return
+		}
+		// The cache records the digests of the raw files, which do not
+		// tell anything about the transformed content.
+		if s.transform == nil && s.cache.isSynced(s.target, c.path, c.fi) {
+			c.same = true
+			return
+		}
+		if checksum, ok := remoteChecksums[c.fi.Name()]; ok {
+			c.remoteChecksum = checksum
+			c.same, c.err = s.matchesChecksum(c.path, checksum)
+			return
+		}
+		c.same, c.remoteChecksum, c.err = s.isSameRevision(s.f5Client, c.fi.Name(), c.path)
+	})
+
+	defer func() {
+		if err := s.cache.save(); err != nil {
+			s.l.Error(err)
+		}
+		s.flushNotifications()
+	}()
+	for _, c := range candidates {
+		if c.err != nil {
+			return c.err
+		}
+	}
+
+	// The transaction is only opened once the comparisons are done so that
+	// it does not expire while the checksums are computed.
+	start := time.Now()
+	tx, err := s.f5Client.Begin()
 	if err != nil {
 		return errors.New("cannot start f5 transaction: " + err.Error())
 	}
-	var totalChanges int
-	for _, fi := range fis {
-		if fi.IsDir() || !fi.Mode().IsRegular() || isExcluded(fi.Name(), excl) {
+	var changes []auditRecord
+	for _, c := range candidates {
+		if c.same {
 			continue
 		}
-		path := filepath.Join(dir, fi.Name())
-		filesize := fi.Size()
-		if filesize == 0 {
+		rec := auditRecord{
+			Action:      "create",
+			Object:      c.fi.Name(),
+			Source:      c.path,
+			Event:       "SCAN",
+			Size:        c.fi.Size(),
+			OldChecksum: c.remoteChecksum,
+		}
+		if c.exists {
+			rec.Action = "update"
+		}
+		if err := s.preHook(rec); err != nil {
+			s.l.Errorf("skipping %q: pre_hook failed: %v", c.path, err)
 			continue
 		}
-		if _, ok := existingFiles[fi.Name()]; !ok {
-			if err := uploadNewFile(tx, fi.Name(), path); err != nil {
-				return err
-			}
-		} else {
-			same, err := isSameRevision(tx, fi.Name(), path)
-			if err != nil {
-				return err
-			}
-			if same {
-				continue
-			}
-			if err := uploadExistingFile(tx, fi.Name(), path); err != nil {
-				return err
+		if err := s.upload(tx, rec.Action, rec.Object, c.path); err != nil {
+			if err := discardTransaction(s.f5Client, tx); err != nil {
+				s.l.Errorf("cannot discard f5 transaction %q: %v", tx.TxID(), err)
 			}
+			stats.observeChange(rec.Action, err)
+			s.setFileStatus(rec.Source, rec.Action, err)
+			s.failed = append(s.failed, s.record(rec, err))
+			return err
 		}
-		totalChanges++
+		changes = append(changes, rec)
+	}
+	if len(changes) == 0 {
+		stats.observeSync(s.cfg.Dir, s.target)
+		return nil
 	}
-	if totalChanges > 0 {
-		if err := tx.Commit(); err != nil {
-			return errors.New("cannot commit transaction: " + err.Error())
+	err = tx.Commit()
+	elapsed := time.Since(start)
+	stats.observeTransaction(elapsed)
+	for _, rec := range changes {
+		stats.observeChange(rec.Action, err)
+		s.setFileStatus(rec.Source, rec.Action, err)
+		if err != nil {
+			s.failed = append(s.failed, s.record(rec, err))
+		}
+	}
+	if err != nil {
+		return errors.New("cannot commit transaction: " + err.Error())
+	}
+	stats.observeSync(s.cfg.Dir, s.target)
+	var verified int
+	for _, rec := range changes {
+		var ok bool
+		rec.NewChecksum, ok = s.verify(rec.Object, rec.Source)
+		if !ok {
+			s.record(rec, errors.New("checksum mismatch"))
+			continue
 		}
+		s.record(rec, nil)
+		s.postHook(rec)
+		verified++
 	}
+	s.l.With(fields{
+		"tx_id":       tx.TxID(),
+		"duration_ms": elapsed.Nanoseconds() / int64(time.Millisecond),
+	}).Noticef("verified %d of %d uploaded files in %q", verified, len(changes), s.cfg.Dir)
 	return nil
 }
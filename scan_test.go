@@ -1,9 +1,367 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/e-XpertSolutions/f5-rest-client/f5"
 )
 
+// ifileStub mimics the iControl REST endpoints of the BigIP used to
+// synchronise iFiles. The changes are applied as soon as they are received.
+type ifileStub struct {
+	uploads *fileTransferStub
+	bulk    bool // whether the checksums can be listed at once
+
+	mu        sync.Mutex
+	checksums map[string]string // of the sys iFiles, by name
+	changes   []string          // method and name of the sys iFiles changes
+	txIDs     map[string]bool   // coordination ids of the changes
+	fail      map[string]bool   // names of the sys iFiles whose changes fail
+	discarded []string          // ids of the deleted transactions
+}
+
+func newIFileStub(bulk bool) *ifileStub {
+	return &ifileStub{
+		uploads:   newFileTransferStub(),
+		bulk:      bulk,
+		checksums: make(map[string]string),
+		txIDs:     make(map[string]bool),
+		fail:      make(map[string]bool),
+	}
+}
+
+func ifileChecksum(data []byte) string {
+	sum := sha1.Sum(data)
+	return fmt.Sprintf("SHA1:%d:%s", len(data), hex.EncodeToString(sum[:]))
+}
+
+func (is *ifileStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, fileTransferPath) {
+		is.uploads.ServeHTTP(w, r)
+		return
+	}
+	if r.Method == "GET" && strings.HasPrefix(r.URL.Path, sysIFilePath+"/") {
+		// Shuffle the order in which the concurrent lookups complete.
+		time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+	}
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	type item struct {
+		Name     string `json:"name"`
+		FullPath string `json:"fullPath,omitempty"`
+		FileName string `json:"fileName,omitempty"`
+		Checksum string `json:"checksum,omitempty"`
+	}
+	var list struct {
+		Items []item `json:"items"`
+	}
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/mgmt/tm/ltm/ifile":
+		for name := range is.checksums {
+			list.Items = append(list.Items, item{Name: name, FullPath: "/Common/" + name, FileName: "/Common/" + name})
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == "GET" && r.URL.Path == sysIFilePath:
+		if !is.bulk {
+			http.Error(w, "unsupported query", http.StatusBadRequest)
+			return
+		}
+		for name, checksum := range is.checksums {
+			list.Items = append(list.Items, item{Name: name, FullPath: "/Common/" + name, Checksum: checksum})
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, sysIFilePath+"/"):
+		name := path.Base(r.URL.Path)
+		checksum, ok := is.checksums[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(item{Name: name, FullPath: "/Common/" + name, Checksum: checksum})
+	case (r.Method == "POST" && r.URL.Path == sysIFilePath) ||
+		(r.Method == "PUT" && strings.HasPrefix(r.URL.Path, sysIFilePath+"/")):
+		var data map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := data["name"]
+		if r.Method == "PUT" {
+			name = path.Base(r.URL.Path)
+		}
+		if is.fail[name] {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		is.uploads.mu.Lock()
+		content, ok := is.uploads.files[path.Base(data["source-path"])]
+		is.uploads.mu.Unlock()
+		if !ok {
+			http.Error(w, "missing source file", http.StatusBadRequest)
+			return
+		}
+		is.checksums[name] = ifileChecksum(content)
+		is.changes = append(is.changes, r.Method+" "+name)
+		is.txIDs[r.Header.Get("X-F5-REST-Coordination-Id")] = true
+		fmt.Fprint(w, "{}")
+	case r.Method == "POST" && r.URL.Path == "/mgmt/tm/transaction":
+		fmt.Fprint(w, `{"transId":1}`)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/mgmt/tm/transaction/"):
+		is.discarded = append(is.discarded, path.Base(r.URL.Path))
+		fmt.Fprint(w, "{}")
+	default:
+		fmt.Fprint(w, "{}")
+	}
+}
+
 func TestScanDir(t *testing.T) {
-	t.Skip()
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.html":       "modified a",
+		"b.html":       "new b",
+		"c.html":       "same c",
+		"d.html":       "modified d",
+		"e.html":       "new e",
+		"my file.html": "invalid name",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal("setup: ", err)
+		}
+	}
+
+	for _, bulk := range []bool{true, false} {
+		bigip := newIFileStub(bulk)
+		bigip.checksums["a.html"] = ifileChecksum([]byte("original a"))
+		bigip.checksums["c.html"] = ifileChecksum([]byte("same c"))
+		bigip.checksums["d.html"] = ifileChecksum([]byte("original d"))
+		ts := httptest.NewServer(bigip)
+
+		c, err := f5.NewBasicClient(ts.URL, "admin", "admin")
+		if err != nil {
+			t.Fatal("setup: ", err)
+		}
+		env := syncEnv{f5Client: c, target: ts.URL, l: discardLogger{}}
+		s, err := newSyncer(env, watchConfig{Type: "ifile", Dir: dir, ScanWorkers: 4})
+		if err != nil {
+			t.Fatal("setup: ", err)
+		}
+
+		if err := scanDir(s); err != nil {
+			t.Errorf("scanDir(bulk=%v): unexpected error %q", bulk, err.Error())
+		}
+		ts.Close()
+
+		// The changes are applied in the order of the directory, within a
+		// single transaction, and the invalid file is skipped.
+		want := []string{"PUT a.html", "POST b.html", "PUT d.html", "POST e.html"}
+		if strings.Join(bigip.changes, ",") != strings.Join(want, ",") {
+			t.Errorf("scanDir(bulk=%v): got changes %q; want %q", bulk, bigip.changes, want)
+		}
+		if len(bigip.txIDs) != 1 || bigip.txIDs[""] {
+			t.Errorf("scanDir(bulk=%v): got changes in transactions %v; want a single transaction", bulk, bigip.txIDs)
+		}
+	}
+}
+
+func TestScanDir_UploadFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+	watchDir := filepath.Join(dir, "watch")
+	if err := os.Mkdir(watchDir, 0755); err != nil {
+		t.Fatal("setup: ", err)
+	}
+	for _, name := range []string{"a.html", "b.html"} {
+		if err := ioutil.WriteFile(filepath.Join(watchDir, name), []byte("new "+name), 0644); err != nil {
+			t.Fatal("setup: ", err)
+		}
+	}
+
+	bigip := newIFileStub(true)
+	bigip.checksums["a.html"] = ifileChecksum([]byte("old a.html"))
+	bigip.fail["b.html"] = true
+	ts := httptest.NewServer(bigip)
+	defer ts.Close()
+
+	var (
+		mu            sync.Mutex
+		notifications []notification
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var nt notification
+		if err := json.NewDecoder(r.Body).Decode(&nt); err != nil {
+			t.Errorf("webhook: cannot decode notification: %v", err)
+		}
+		mu.Lock()
+		notifications = append(notifications, nt)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	n, err := newNotifier(notifyConfig{URL: hook.URL}, discardLogger{})
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+
+	auditPath := filepath.Join(dir, "audit.log")
+	audit, err := openAuditLog(auditPath, 0, 0)
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer audit.close()
+	cachePath := filepath.Join(dir, "cache.json")
+	cache, err := loadHashCache(cachePath)
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+
+	c, err := f5.NewBasicClient(ts.URL, "admin", "admin")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	env := syncEnv{f5Client: c, target: ts.URL, l: discardLogger{}, cache: cache, audit: audit, notify: notifiers{n}}
+	s, err := newSyncer(env, watchConfig{Type: "ifile", Dir: watchDir})
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	if err := scanDir(s); err == nil {
+		t.Fatal("scanDir(): got no error; want upload failure")
+	}
+	n.close()
+
+	if want := []string{"1"}; strings.Join(bigip.discarded, ",") != strings.Join(want, ",") {
+		t.Errorf("scanDir(): got discarded transactions %q; want %q", bigip.discarded, want)
+	}
+	data, err := ioutil.ReadFile(auditPath)
+	if err != nil {
+		t.Fatalf("cannot read audit log: %v", err)
+	}
+	if !strings.Contains(string(data), `"object":"b.html"`) || !strings.Contains(string(data), `"result":"failure"`) {
+		t.Errorf("scanDir(): got audit log %q; want the failed upload of b.html", data)
+	}
+	if len(notifications) != 1 || notifications[0].Event != notifyFailed ||
+		len(notifications[0].Changes) != 1 || notifications[0].Changes[0].Object != "b.html" {
+		t.Errorf("scanDir(): got notifications %+v; want the failed upload of b.html", notifications)
+	}
+	if _, err := os.Stat(cachePath); err != nil {
+		t.Errorf("scanDir(): cache not saved: %v", err)
+	}
+}
+
+func TestScanDir_Transform(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+	watchDir := filepath.Join(dir, "watch")
+	if err := os.Mkdir(watchDir, 0755); err != nil {
+		t.Fatal("setup: ", err)
+	}
+	path := filepath.Join(watchDir, "index.html")
+	content := []byte("<p>{{.Vars.env}}</p>")
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal("setup: ", err)
+	}
+
+	bigip := newIFileStub(true)
+	bigip.checksums["index.html"] = ifileChecksum(content)
+	ts := httptest.NewServer(bigip)
+	defer ts.Close()
+
+	// The cache says that the raw file was synchronised before the
+	// transformation was enabled.
+	cache, err := loadHashCache(filepath.Join(dir, "cache.json"))
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	digest, err := cache.checksum(path, "SHA1")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	cache.setRemote(ts.URL, path, "SHA1:20:"+digest)
+
+	c, err := f5.NewBasicClient(ts.URL, "admin", "admin")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	env := syncEnv{f5Client: c, target: ts.URL, l: discardLogger{}, cache: cache}
+	s, err := newSyncer(env, watchConfig{
+		Type:         "ifile",
+		Dir:          watchDir,
+		Transform:    []string{"template"},
+		TemplateVars: map[string]string{"env": "prod"},
+	})
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	if err := scanDir(s); err != nil {
+		t.Fatalf("scanDir(): unexpected error %q", err.Error())
+	}
+	if want := []string{"PUT index.html"}; strings.Join(bigip.changes, ",") != strings.Join(want, ",") {
+		t.Errorf("scanDir(): got changes %q; want %q", bigip.changes, want)
+	}
+	if got, want := bigip.checksums["index.html"], ifileChecksum([]byte("<p>prod</p>")); got != want {
+		t.Errorf("scanDir(): got remote checksum %q; want %q of the transformed content", got, want)
+	}
+}
+
+func TestRunPool(t *testing.T) {
+	tests := []struct {
+		n, workers, wantMax int
+	}{
+		{0, 4, 0},
+		{3, 8, 3},
+		{20, 4, 4},
+		{20, 0, defaultScanWorkers},
+	}
+	for _, test := range tests {
+		var (
+			mu              sync.Mutex
+			running, maxRun int
+			seen            = make([]int, test.n)
+		)
+		runPool(test.n, test.workers, func(i int) {
+			mu.Lock()
+			running++
+			if running > maxRun {
+				maxRun = running
+			}
+			seen[i]++
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		})
+		for i, count := range seen {
+			if count != 1 {
+				t.Errorf("runPool(%d, %d): index %d processed %d times; want 1", test.n, test.workers, i, count)
+			}
+		}
+		if maxRun > test.wantMax || (test.n > 0 && maxRun == 0) {
+			t.Errorf("runPool(%d, %d): got %d concurrent calls; want at most %d", test.n, test.workers, maxRun, test.wantMax)
+		}
+	}
 }
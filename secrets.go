@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/e-XpertSolutions/go-secret/secret"
+)
+
+// Keys under which the credentials are kept in the secret store. The
+// credentials specific to a target are prefixed by its name followed by a
+// slash, e.g. "bigip1.example.com/password". The targets having their own
+// credentials are listed, one per line, under secretTargetsKey.
+const (
+	secretUsernameKey = "username"
+	secretPasswordKey = "password"
+	secretTargetsKey  = "targets"
+)
+
+// credentialTarget returns the name of the target of the credentials used to
+// connect to the BigIP located at rawurl, i.e. its host.
+func credentialTarget(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// credentialKeys returns the keys of the username and password of target, or
+// the default ones when target is empty.
+func credentialKeys(target string) (usernameKey, passwordKey string) {
+	if target == "" {
+		return secretUsernameKey, secretPasswordKey
+	}
+	return target + "/" + secretUsernameKey, target + "/" + secretPasswordKey
+}
+
+// lookupCredentials returns the credentials of target, falling back to the
+// default ones. It also returns the target the credentials belong to, empty
+// for the default ones.
+func lookupCredentials(store *secret.Store, target string) (username, password, found string, err error) {
+	if target != "" {
+		userKey, passKey := credentialKeys(target)
+		if value, err := store.Get(userKey); err == nil && len(value) > 0 {
+			pass, err := store.Get(passKey)
+			if err != nil {
+				return "", "", "", err
+			}
+			return string(value), string(pass), target, nil
+		}
+	}
+	value, err := store.Get(secretUsernameKey)
+	if err != nil {
+		return "", "", "", err
+	}
+	pass, err := store.Get(secretPasswordKey)
+	if err != nil {
+		return "", "", "", err
+	}
+	return string(value), string(pass), "", nil
+}
+
+// storeTargets returns the targets having their own credentials in store.
+func storeTargets(store *secret.Store) []string {
+	value, err := store.Get(secretTargetsKey)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(value))
+}
+
+// setCredentials stores the credentials of target, or the default ones when
+// target is empty.
+func setCredentials(store *secret.Store, target, username, password string) error {
+	userKey, passKey := credentialKeys(target)
+	if err := store.Set(userKey, []byte(username)); err != nil {
+		return fmt.Errorf("cannot store username: %v", err)
+	}
+	if err := store.Set(passKey, []byte(password)); err != nil {
+		return fmt.Errorf("cannot store password: %v", err)
+	}
+	if target == "" {
+		return nil
+	}
+	targets := storeTargets(store)
+	for _, t := range targets {
+		if t == target {
+			return nil
+		}
+	}
+	targets = append(targets, target)
+	sort.Strings(targets)
+	if err := store.Set(secretTargetsKey, []byte(strings.Join(targets, "\n"))); err != nil {
+		return fmt.Errorf("cannot store targets: %v", err)
+	}
+	return nil
+}
+
+// credentials is a pair of username/password.
+type credentials struct {
+	username, password string
+}
+
+// writeSecretStore creates, or replaces, the secret store located at path
+// with the given credentials, indexed by target.
+func writeSecretStore(path, passphrase string, creds map[string]credentials) error {
+	targets := make([]string, 0, len(creds))
+	for target := range creds {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return saveSecretStore(path, passphrase, func(store *secret.Store) error {
+		for _, target := range targets {
+			if err := setCredentials(store, target, creds[target].username, creds[target].password); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// saveSecretStore creates, or replaces, the secret store located at path with
+// the entries set by fill. The store is written aside and then renamed so that
+// the previous one is kept if anything goes wrong. It is only readable by its
+// owner.
+func saveSecretStore(path, passphrase string, fill func(*secret.Store) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("cannot create secret store directory: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot create secret store: %v", err)
+	}
+	store, err := secret.OpenStore(tmp, passphrase)
+	if err != nil {
+		return fmt.Errorf("cannot create secret store: %v", err)
+	}
+	if err := fill(store); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := store.Save(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot save secret store: %v", err)
+	}
+	if err := os.Chmod(tmp, 0600); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot set permissions of secret store: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot replace secret store: %v", err)
+	}
+	return nil
+}
+
+// openSecretStore opens the existing secret store located at path.
+func openSecretStore(path, passphrase string) (*secret.Store, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("cannot open secret store: %v", err)
+	}
+	store, err := secret.OpenStore(path, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open secret store: %v", err)
+	}
+	return store, nil
+}
+
+func secretsUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "usage: %s secrets [flags] set|rotate-passphrase|verify\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+		exit(1)
+	}
+}
+
+// runSecrets implements the secrets sub-command which manages the secret
+// store holding the credentials.
+func runSecrets(args []string) {
+	fs := flag.NewFlagSet("secrets", flag.ExitOnError)
+	fs.Usage = secretsUsage(fs)
+	cfgPath := fs.String("config", "config.toml", "path to configuration file")
+	storePath := fs.String("store", "", "path to secret store (default: read from the configuration file)")
+	target := fs.String("target", "", "host of the BigIP whose credentials are set (default: credentials shared by all the BigIPs)")
+	username := fs.String("username", "", "username to store (default: asked)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return
+	}
+	cmd := fs.Arg(0)
+	switch cmd {
+	case "set", "rotate-passphrase", "verify":
+	default:
+		fs.Usage()
+		return
+	}
+
+	// The configuration file is only mandatory to verify the credentials.
+	cfg, err := readConfig(*cfgPath)
+	if err != nil && (cmd == "verify" || *storePath == "") {
+		fatal(err)
+		return
+	}
+	var passphrase string
+	if cfg != nil {
+		if *storePath == "" {
+			*storePath = cfg.SecretStorePath
+		}
+		if *storePath == cfg.SecretStorePath {
+			passphrase = cfg.Passphrase
+		}
+	}
+	if *storePath == "" {
+		fatal("no secret store configured")
+		return
+	}
+	if passphrase == "" {
+		if passphrase, err = askPassword("Secret store passphrase", false); err != nil {
+			fatal(err)
+			return
+		}
+	}
+
+	switch cmd {
+	case "set":
+		err = secretsSet(*storePath, passphrase, *target, *username)
+	case "rotate-passphrase":
+		err = secretsRotatePassphrase(*storePath, passphrase)
+	case "verify":
+		err = secretsVerify(cfg, *storePath, passphrase)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// secretsSet stores the credentials of target, asked on the terminal, into
+// the secret store. The store is created if needed.
+func secretsSet(path, passphrase, target, username string) error {
+	if username == "" {
+		p := &prompter{r: bufio.NewReader(stdin), w: stdout}
+		var err error
+		for username == "" {
+			if username, err = p.ask("Username", ""); err != nil {
+				return err
+			}
+		}
+	}
+	password, err := askPassword("Password", true)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		creds := map[string]credentials{target: {username, password}}
+		if err := writeSecretStore(path, passphrase, creds); err != nil {
+			return err
+		}
+	} else {
+		store, err := openSecretStore(path, passphrase)
+		if err != nil {
+			return err
+		}
+		if err := setCredentials(store, target, username, password); err != nil {
+			return err
+		}
+		if err := store.Save(); err != nil {
+			return fmt.Errorf("cannot save secret store: %v", err)
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			return fmt.Errorf("cannot set permissions of secret store: %v", err)
+		}
+	}
+	if target == "" {
+		info(fmt.Sprintf("default credentials written to %q", path))
+	} else {
+		info(fmt.Sprintf("credentials of %q written to %q", target, path))
+	}
+	return nil
+}
+
+// secretKeys returns the keys of all the entries that may be held by store:
+// the default credentials, the list of targets and the credentials of each of
+// them. The secret store cannot list its keys, hence they are derived from the
+// list of targets.
+func secretKeys(store *secret.Store) []string {
+	keys := []string{secretUsernameKey, secretPasswordKey, secretTargetsKey}
+	for _, target := range storeTargets(store) {
+		userKey, passKey := credentialKeys(target)
+		keys = append(keys, userKey, passKey)
+	}
+	return keys
+}
+
+// secretsRotatePassphrase re-encrypts the secret store with a new passphrase
+// asked on the terminal. Every entry is copied as is, including incomplete
+// credentials.
+func secretsRotatePassphrase(path, passphrase string) error {
+	store, err := openSecretStore(path, passphrase)
+	if err != nil {
+		return err
+	}
+	entries := make(map[string][]byte)
+	for _, key := range secretKeys(store) {
+		value, err := store.Get(key)
+		if err != nil {
+			// The store may only hold the credentials of some targets.
+			continue
+		}
+		entries[key] = value
+	}
+	if len(entries) == 0 {
+		return errors.New("the secret store does not contain any credentials")
+	}
+
+	newPassphrase, err := askPassword("New secret store passphrase", true)
+	if err != nil {
+		return err
+	}
+	err = saveSecretStore(path, newPassphrase, func(store *secret.Store) error {
+		for key, value := range entries {
+			if err := store.Set(key, value); err != nil {
+				return fmt.Errorf("cannot store %q: %v", key, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	info(fmt.Sprintf("passphrase of %q rotated, update the token setting of the configuration file accordingly", path))
+	return nil
+}
+
+// secretsVerify checks that the secret store can be opened and that its
+// credentials give access to the configured BigIP.
+func secretsVerify(cfg *config, path, passphrase string) error {
+	store, err := openSecretStore(path, passphrase)
+	if err != nil {
+		return err
+	}
+	username, password, found, err := lookupCredentials(store, credentialTarget(cfg.F5.URL))
+	if err != nil {
+		return fmt.Errorf("cannot read credentials: %v", err)
+	}
+	if username == "" || password == "" {
+		return fmt.Errorf("no credentials found for %q", cfg.F5.URL)
+	}
+	if found == "" {
+		info("using default credentials")
+	} else {
+		info(fmt.Sprintf("using credentials of %q", found))
+	}
+
+	f5Cfg := cfg.F5
+	f5Cfg.User, f5Cfg.Password = username, password
+	f5Client, err := initF5Client(f5Cfg)
+	if err != nil {
+		return err
+	}
+	if !f5Client.IsActive() {
+		return fmt.Errorf("big-ip instance %q is not available with the stored credentials", cfg.F5.URL)
+	}
+	info(fmt.Sprintf("credentials for %q are valid", cfg.F5.URL))
+	return nil
+}
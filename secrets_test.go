@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/e-XpertSolutions/go-secret/secret"
+)
+
+func TestSecretsSetAndRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store")
+
+	restore := scriptInit("admin\n", "default", "default", "bigip1", "bigip1", "new", "new")
+	defer restore()
+
+	if err := secretsSet(path, "passphrase", "", ""); err != nil {
+		t.Fatalf("secretsSet: unexpected error %q", err.Error())
+	}
+	if err := secretsSet(path, "passphrase", "bigip1:443", "root"); err != nil {
+		t.Fatalf("secretsSet: unexpected error %q", err.Error())
+	}
+	if err := secretsRotatePassphrase(path, "passphrase"); err != nil {
+		t.Fatalf("secretsRotatePassphrase: unexpected error %q", err.Error())
+	}
+
+	tests := []struct {
+		target, wantUser, wantPass string
+	}{
+		{"", "admin", "default"},
+		{"bigip1:443", "root", "bigip1"},
+		{"bigip2", "admin", "default"},
+	}
+	for _, test := range tests {
+		user, pass, err := readUserCredentials(path, "new", test.target)
+		if err != nil {
+			t.Errorf("readUserCredentials(%q): unexpected error %q", test.target, err.Error())
+			continue
+		}
+		if user != test.wantUser || pass != test.wantPass {
+			t.Errorf("readUserCredentials(%q): got %q/%q; want %q/%q",
+				test.target, user, pass, test.wantUser, test.wantPass)
+		}
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		t.Errorf("secret store has permissions %v; want none for group and others", perm)
+	}
+}
+
+func TestSecretsRotatePassphrase_TargetsOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store")
+
+	restore := scriptInit("", "bigip1", "bigip1", "new", "new")
+	defer restore()
+
+	// The store does not hold any default credentials.
+	if err := secretsSet(path, "passphrase", "bigip1:443", "root"); err != nil {
+		t.Fatalf("secretsSet: unexpected error %q", err.Error())
+	}
+	if err := secretsRotatePassphrase(path, "passphrase"); err != nil {
+		t.Fatalf("secretsRotatePassphrase: unexpected error %q", err.Error())
+	}
+	user, pass, err := readUserCredentials(path, "new", "bigip1:443")
+	if err != nil {
+		t.Fatalf("readUserCredentials(%q): unexpected error %q", "bigip1:443", err.Error())
+	}
+	if user != "root" || pass != "bigip1" {
+		t.Errorf("readUserCredentials(%q): got %q/%q; want %q/%q", "bigip1:443", user, pass, "root", "bigip1")
+	}
+}
+
+func TestSecretsRotatePassphrase_KeepsEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store")
+
+	restore := scriptInit("", "new", "new")
+	defer restore()
+
+	// The credentials of bigip2 are incomplete and those of bigip3 have an
+	// empty username.
+	entries := map[string]string{
+		"username":        "admin",
+		"password":        "default",
+		"targets":         "bigip1\nbigip2\nbigip3",
+		"bigip1/username": "root",
+		"bigip1/password": "bigip1",
+		"bigip2/password": "bigip2",
+		"bigip3/username": "",
+		"bigip3/password": "bigip3",
+	}
+	store, err := secret.OpenStore(path, "passphrase")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	for key, value := range entries {
+		if err := store.Set(key, []byte(value)); err != nil {
+			t.Fatal("setup: ", err)
+		}
+	}
+	if err := store.Save(); err != nil {
+		t.Fatal("setup: ", err)
+	}
+
+	if err := secretsRotatePassphrase(path, "passphrase"); err != nil {
+		t.Fatalf("secretsRotatePassphrase: unexpected error %q", err.Error())
+	}
+	store, err = openSecretStore(path, "new")
+	if err != nil {
+		t.Fatalf("openSecretStore: unexpected error %q", err.Error())
+	}
+	for key, want := range entries {
+		got, err := store.Get(key)
+		if err != nil {
+			t.Errorf("secretsRotatePassphrase: entry %q lost: %v", key, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("secretsRotatePassphrase: got %q for entry %q; want %q", got, key, want)
+		}
+	}
+}
+
+func TestCredentialTarget(t *testing.T) {
+	tests := map[string]string{
+		"https://bigip1.example.com":      "bigip1.example.com",
+		"https://bigip1.example.com:8443": "bigip1.example.com:8443",
+		"%":                               "",
+	}
+	for in, want := range tests {
+		if got := credentialTarget(in); got != want {
+			t.Errorf("credentialTarget(%q): got %q; want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/e-XpertSolutions/f5-rest-client/f5"
+	fsnotify "gopkg.in/fsnotify.v1"
+)
+
+// syncEnv groups what is shared by the syncers of all the watches.
+type syncEnv struct {
+	f5Client *f5.Client
+	target   string // URL of the BigIP
+	l        logger
+	cache    *hashCache // may be nil
+	audit    *auditLog  // may be nil
+	notify   notifiers
+	uploader *uploader // may be nil
+}
+
+// syncer applies the changes made in a watched directory onto the BigIP.
+type syncer struct {
+	syncEnv
+	h         handler
+	cfg       watchConfig
+	filter    *fileFilter
+	guard     *guard
+	transform *transformer // may be nil
+	retries   *retryQueue
+
+	// syncMu serialises the synchronisations of the directory and guards
+	// the changes batched for the next notification.
+	syncMu   sync.Mutex
+	deployed []auditRecord
+	failed   []auditRecord
+
+	mu     sync.Mutex
+	paused bool
+	held   map[string]fsnotify.Op // events received while paused
+	files  map[string]*fileStatus
+}
+
+// fileStatus is the outcome of the last change applied for a file.
+type fileStatus struct {
+	Action   string    `json:"action"`
+	Error    string    `json:"error,omitempty"`
+	Checksum string    `json:"checksum,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+func newSyncer(env syncEnv, cfg watchConfig) (*syncer, error) {
+	h, err := lookupHandler(cfg.Type)
+	if err != nil {
+		return nil, err
+	}
+	env.l = env.l.With(fields{"watch": cfg.Dir})
+	filter, err := newFileFilter(cfg.Dir, true, cfg.Include, cfg.Exclude, env.l)
+	if err != nil {
+		return nil, err
+	}
+	transform, err := newTransformer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &syncer{
+		syncEnv:   env,
+		h:         h,
+		cfg:       cfg,
+		filter:    filter,
+		guard:     newGuard(cfg),
+		transform: transform,
+		retries:   newRetryQueue(),
+		held:      make(map[string]fsnotify.Op),
+		files:     make(map[string]*fileStatus),
+	}
+	stats.registerRetryQueue(cfg.Dir, s.retries)
+	return s, nil
+}
+
+// actionOf returns the name of the action triggered by e, as used in the
+// metrics.
+func actionOf(e watchEvent) string {
+	switch {
+	case e.isCreate():
+		return "create"
+	case e.isWrite():
+		return "update"
+	default:
+		return "delete"
+	}
+}
+
+// eventName returns the name of the file system event e.
+func eventName(e watchEvent) string {
+	switch {
+	case e.isCreate():
+		return "CREATE"
+	case e.isWrite():
+		return "WRITE"
+	case e.isRename():
+		return "RENAME"
+	default:
+		return "REMOVE"
+	}
+}
+
+// outcome is the result of syncEvent.
+type outcome int
+
+const (
+	outcomeSkipped  outcome = iota // nothing was done
+	outcomeFailed                  // the change failed and has been scheduled for retry
+	outcomeDeleted                 // the object has been deleted
+	outcomeVerified                // the file has been uploaded and verified
+	outcomeMismatch                // the file has been uploaded but failed verification
+)
+
+// syncEvents applies each event within its own transaction. Failed changes
+// are scheduled for retry and uploaded files are verified once committed.
+// While the syncer is paused, events are held until it is resumed.
+func (s *syncer) syncEvents(events []watchEvent) {
+	s.mu.Lock()
+	if s.paused {
+		for _, e := range events {
+			s.held[e.Name] |= e.Op
+		}
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	var verified, total int
+	for _, e := range events {
+		switch s.syncEvent(e) {
+		case outcomeSkipped, outcomeDeleted:
+			s.retries.done(e.Name)
+		case outcomeVerified:
+			s.retries.done(e.Name)
+			verified++
+			total++
+		case outcomeMismatch:
+			total++
+		}
+	}
+	if total > 0 {
+		s.l.Noticef("verified %d of %d uploaded files in %q", verified, total, s.cfg.Dir)
+	}
+	if err := s.cache.save(); err != nil {
+		s.l.Error(err)
+	}
+	s.flushNotifications()
+}
+
+// syncEvent applies e onto the BigIP and, for uploads, verifies the result.
+// Changes that fail are scheduled for retry.
+func (s *syncer) syncEvent(e watchEvent) outcome {
+	name := filepath.Base(e.Name)
+	action := actionOf(e)
+	l := s.l.With(fields{"file": e.Name, "iFile": name, "action": action})
+
+	if s.filter.isIgnoreFile(e.Name) {
+		if err := s.filter.reload(); err != nil {
+			l.Errorf("keeping previous ignore patterns: %v", err)
+		} else {
+			l.Noticef("ignore patterns reloaded from %q", e.Name)
+		}
+		return outcomeSkipped
+	}
+	if s.filter.skip(e.Name, false) {
+		l.Noticef("skipping %q due to an inclusion or exclusion pattern", e.Name)
+		return outcomeSkipped
+	}
+
+	if e.isRemove() && !s.cfg.RemoveRemoveFiles {
+		return outcomeSkipped
+	}
+	if e.isRemove() || e.isRename() {
+		if err := checkDelete(s.f5Client, l, s.h, name, s.cfg.ForceDelete); err != nil {
+			l.Errorf("skipping %q: %v", e.Name, err)
+			return outcomeSkipped
+		}
+	} else if err := s.checkGuard(e.Name); err != nil {
+		if _, ok := err.(*guardError); !ok {
+			l.Errorf("skipping %q: %v", e.Name, err)
+		}
+		s.setFileStatus(e.Name, action, err)
+		return outcomeSkipped
+	} else if err := s.h.Validate(name, e.Name); err != nil {
+		l.Errorf("skipping %q: %v", e.Name, err)
+		return outcomeSkipped
+	}
+
+	rec := auditRecord{
+		Object: name,
+		Action: action,
+		Source: e.Name,
+		Event:  eventName(e),
+		Size:   fileSize(e.Name),
+	}
+	if err := s.preHook(rec); err != nil {
+		l.Errorf("skipping %q: pre_hook failed: %v", e.Name, err)
+		s.setFileStatus(e.Name, action, err)
+		s.record(rec, err)
+		return outcomeSkipped
+	}
+	if s.audit != nil && !e.isCreate() {
+		// Only fetched for the audit trail, the object may not exist.
+		rec.OldChecksum, _ = s.h.Checksum(s.f5Client, name)
+	}
+
+	start := time.Now()
+	tx, err := s.f5Client.Begin()
+	if err != nil {
+		l.Errorf("cannot start f5 transaction for file %q", e.Name)
+		stats.observeChange(action, err)
+		s.record(rec, err)
+		s.retry(e, err)
+		return outcomeFailed
+	}
+	l = l.With(fields{"tx_id": tx.TxID()})
+
+	l.Noticef("event received %q for file %q", eventName(e), e.Name)
+	switch {
+	case e.isCreate(), e.isWrite():
+		err = s.upload(tx, action, name, e.Name)
+	default:
+		err = s.h.Delete(tx, name)
+		s.cache.forget(e.Name)
+	}
+	if err != nil {
+		l.Errorf("cannot upload file %q: %v", e.Name, err)
+		if err := discardTransaction(s.f5Client, tx); err != nil {
+			l.Errorf("cannot discard f5 transaction: %v", err)
+		}
+		stats.observeChange(action, err)
+		s.setFileStatus(e.Name, action, err)
+		s.record(rec, err)
+		s.retry(e, err)
+		return outcomeFailed
+	}
+
+	err = tx.Commit()
+	elapsed := time.Since(start)
+	l = l.With(fields{"duration_ms": elapsed.Nanoseconds() / int64(time.Millisecond)})
+	stats.observeTransaction(elapsed)
+	stats.observeChange(action, err)
+	s.setFileStatus(e.Name, action, err)
+	if err != nil {
+		l.Errorf("cannot commit f5 transaction for file %q: %v", e.Name, err)
+		s.record(rec, err)
+		s.retry(e, err)
+		return outcomeFailed
+	}
+	l.Infof("f5 transaction committed for file %q", e.Name)
+	stats.observeSync(s.cfg.Dir, s.target)
+
+	if action == "delete" {
+		s.record(rec, nil)
+		s.postHook(rec)
+		return outcomeDeleted
+	}
+	var ok bool
+	rec.NewChecksum, ok = s.verify(name, e.Name)
+	if !ok {
+		s.record(rec, errors.New("checksum mismatch"))
+		return outcomeMismatch
+	}
+	s.record(rec, nil)
+	s.postHook(rec)
+	return outcomeVerified
+}
+
+// upload creates, or updates when action is "update", the named object with
+// the content of the file located at path, once transformed.
+func (s *syncer) upload(tx *f5.Client, action, name, path string) error {
+	src, err := s.open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if action == "update" {
+		return s.h.Update(tx, name, src)
+	}
+	return s.h.Create(tx, name, src)
+}
+
+// isSameRevision reports whether the local file located at path has the same
+// content, once transformed, as the named object on the BigIP. It also
+// returns the checksum of the remote object.
+func (s *syncer) isSameRevision(c *f5.Client, name, path string) (bool, string, error) {
+	remoteChecksum, err := s.h.Checksum(c, name)
+	if err != nil {
+		return false, "", err
+	}
+
+	same, err := s.matchesChecksum(path, remoteChecksum)
+	return same, remoteChecksum, err
+}
+
+// matchesChecksum reports whether the local file located at path, once
+// transformed, matches remoteChecksum as reported by the BigIP.
+func (s *syncer) matchesChecksum(path, remoteChecksum string) (bool, error) {
+	algo, _, checksum := splitChecksum(remoteChecksum)
+
+	expectedChecksum, err := s.checksum(path, algo)
+	if err != nil {
+		return false, err
+	}
+	if s.transform == nil {
+		s.cache.setRemote(s.target, path, remoteChecksum)
+	}
+
+	return checksum == expectedChecksum, nil
+}
+
+// discardTransaction deletes the transaction tx, opened from c, so that none
+// of the changes it holds gets applied.
+func discardTransaction(c, tx *f5.Client) error {
+	return c.ModQuery("DELETE", "/mgmt/tm/transaction/"+tx.TxID(), nil)
+}
+
+// verify checks that the object stored on the BigIP matches the local file.
+// On mismatch, the file is scheduled to be uploaded again. It returns the
+// checksum reported by the BigIP.
+func (s *syncer) verify(name, path string) (string, bool) {
+	same, checksum, err := s.isSameRevision(s.f5Client, name, path)
+	if err == nil && !same {
+		err = errors.New("checksum mismatch")
+	}
+	s.mu.Lock()
+	if fs, ok := s.files[path]; ok {
+		fs.Checksum = checksum
+		if err != nil {
+			fs.Error = err.Error()
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		s.l.With(fields{"file": path, "iFile": name}).Errorf("cannot verify upload of %q: %v", path, err)
+		s.retry(watchEvent{Name: path, Op: fsnotify.Write}, err)
+		return checksum, false
+	}
+	return checksum, true
+}
+
+// retry schedules e, which failed with err, to be applied again later.
+func (s *syncer) retry(e watchEvent, err error) {
+	if s.retries.add(e) {
+		return
+	}
+	s.l.Errorf("giving up on %q after %d attempts", e.Name, maxRetryAttempts)
+	s.failed = append(s.failed, auditRecord{
+		Time:      time.Now(),
+		Target:    s.target,
+		Partition: defaultPartition,
+		Object:    filepath.Base(e.Name),
+		Action:    actionOf(e),
+		Source:    e.Name,
+		Event:     eventName(e),
+		Result:    "failure",
+		Error:     fmt.Sprintf("giving up after %d attempts: %v", maxRetryAttempts, err),
+	})
+}
+
+// record appends rec to the audit log along with the result of the change and
+// returns the completed record. Successful changes are batched for the next
+// notification.
+func (s *syncer) record(rec auditRecord, err error) auditRecord {
+	rec.Time = time.Now()
+	rec.Target = s.target
+	rec.Partition = defaultPartition
+	rec.Result = "success"
+	if err != nil {
+		rec.Result = "failure"
+		rec.Error = err.Error()
+	} else {
+		s.deployed = append(s.deployed, rec)
+	}
+	if s.audit == nil {
+		return rec
+	}
+	if err := s.audit.record(rec); err != nil {
+		s.l.Errorf("cannot write audit record for %q: %v", rec.Source, err)
+	}
+	return rec
+}
+
+// flushNotifications sends the batched changes to the webhooks.
+func (s *syncer) flushNotifications() {
+	now := time.Now()
+	s.notify.send(notification{Event: notifyDeployed, Target: s.target, Watch: s.cfg.Dir, Time: now, Changes: s.deployed})
+	s.notify.send(notification{Event: notifyFailed, Target: s.target, Watch: s.cfg.Dir, Time: now, Changes: s.failed})
+	s.deployed, s.failed = nil, nil
+}
+
+// fileSize returns the size of the file located at path, or 0 if it cannot be
+// determined.
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// setFileStatus records the outcome of the last action applied for path.
+func (s *syncer) setFileStatus(path, action string, err error) {
+	fs := &fileStatus{Action: action, Time: time.Now()}
+	if err != nil {
+		fs.Error = err.Error()
+	}
+	s.mu.Lock()
+	s.files[path] = fs
+	s.mu.Unlock()
+}
+
+// pause stops applying changes. Events received in the meantime are held
+// until resume is called.
+func (s *syncer) pause() {
+	s.mu.Lock()
+	s.paused = true
+	s.mu.Unlock()
+}
+
+// resume applies the held events and starts applying changes again.
+func (s *syncer) resume() {
+	s.mu.Lock()
+	if !s.paused {
+		s.mu.Unlock()
+		return
+	}
+	s.paused = false
+	held := s.held
+	s.held = make(map[string]fsnotify.Op)
+	s.mu.Unlock()
+
+	if events := resolveEvents(held); len(events) > 0 {
+		s.l.Noticef("applying %d changes held while %q was paused", len(events), s.cfg.Dir)
+		s.syncEvents(events)
+	}
+}
+
+// isPaused reports whether the syncer is paused along with the number of
+// held events.
+func (s *syncer) isPaused() (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused, len(s.held)
+}
+
+// status returns a copy of the status of the files.
+func (s *syncer) status() map[string]fileStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make(map[string]fileStatus, len(s.files))
+	for path, fs := range s.files {
+		files[path] = *fs
+	}
+	return files
+}
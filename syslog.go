@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslogFacilities maps the syslog facility names to their code.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverity returns the syslog severity matching lvl.
+func syslogSeverity(lvl level) int {
+	switch lvl {
+	case levelDebug:
+		return 7
+	case levelInfo:
+		return 6
+	case levelNotice:
+		return 5
+	case levelWarn:
+		return 4
+	default:
+		return 3
+	}
+}
+
+// syslogSDID is the identifier of the structured data element holding the
+// fields of the log entries.
+const syslogSDID = "fields@32473"
+
+const (
+	syslogDialTimeout = 5 * time.Second
+
+	// After a failed dial, the entries are dropped for a delay doubled
+	// after each new failure, from syslogMinBackoff to syslogMaxBackoff.
+	syslogMinBackoff = time.Second
+	syslogMaxBackoff = time.Minute
+)
+
+// syslogSink sends the log entries to a syslog daemon or relay formatted
+// according to RFC 5424.
+type syslogSink struct {
+	mu       sync.Mutex
+	network  string // "unixgram", "unix", "udp" or "tcp"
+	address  string
+	facility int
+	tag      string
+	hostname string
+	min      level
+	dial     func(network, address string, timeout time.Duration) (net.Conn, error)
+	conn     net.Conn
+	backoff  time.Duration
+	retryAt  time.Time // no dial is attempted before
+	dropped  int       // entries dropped while the relay was unreachable
+}
+
+// newSyslogSink returns a sink sending the entries of level min and above to
+// the syslog daemon listening on address. An empty network and address
+// stands for the local /dev/log socket.
+func newSyslogSink(network, address, facility, tag string, min level) (*syslogSink, error) {
+	if network == "" && address == "" {
+		network, address = "unixgram", "/dev/log"
+	}
+	switch network {
+	case "unixgram", "unix", "udp", "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q", network)
+	}
+	if facility == "" {
+		facility = "daemon"
+	}
+	code, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &syslogSink{
+		network:  network,
+		address:  address,
+		facility: code,
+		tag:      tag,
+		hostname: hostname,
+		min:      min,
+		dial:     net.DialTimeout,
+	}, nil
+}
+
+func (ss *syslogSink) write(e logEntry) {
+	if e.level < ss.min {
+		return
+	}
+	msg := formatRFC5424(e, ss.facility, ss.hostname, ss.tag, os.Getpid())
+	if ss.network == "tcp" || ss.network == "unix" {
+		// Octet counting framing, see RFC 6587.
+		msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.conn == nil && time.Now().Before(ss.retryAt) {
+		// The relay is unreachable, do not block on dialing it again.
+		ss.dropped++
+		return
+	}
+	// Try twice so that a broken connection gets re-established.
+	var err error
+	for i := 0; i < 2; i++ {
+		if ss.conn == nil {
+			if err = ss.connect(); err != nil {
+				ss.dropped++
+				return
+			}
+		}
+		if _, err = ss.conn.Write(msg); err == nil {
+			return
+		}
+		ss.conn.Close()
+		ss.conn = nil
+	}
+	fmt.Fprintf(stderr, "cannot write log entry to syslog %s %q: %v\n", ss.network, ss.address, err)
+}
+
+// connect dials the syslog daemon. On failure, no other attempt is made until
+// the backoff delay expires. Callers must hold ss.mu.
+func (ss *syslogSink) connect() error {
+	conn, err := ss.dial(ss.network, ss.address, syslogDialTimeout)
+	if err != nil {
+		if ss.backoff == 0 {
+			ss.backoff = syslogMinBackoff
+		} else if ss.backoff *= 2; ss.backoff > syslogMaxBackoff {
+			ss.backoff = syslogMaxBackoff
+		}
+		ss.retryAt = time.Now().Add(ss.backoff)
+		fmt.Fprintf(stderr, "cannot connect to syslog %s %q, dropping log entries for %v: %v\n", ss.network, ss.address, ss.backoff, err)
+		return err
+	}
+	if ss.dropped > 0 {
+		fmt.Fprintf(stderr, "connected to syslog %s %q again, %d log entries were dropped\n", ss.network, ss.address, ss.dropped)
+	}
+	ss.conn = conn
+	ss.backoff = 0
+	ss.dropped = 0
+	return nil
+}
+
+// formatRFC5424 formats e as a syslog message. The fields of the entry are
+// sent as structured data.
+func formatRFC5424(e logEntry, facility int, hostname, tag string, pid int) []byte {
+	if tag == "" {
+		tag = "-"
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "<%d>1 %s %s %s %d - ",
+		facility*8+syslogSeverity(e.level),
+		e.time.Format(time.RFC3339Nano),
+		hostname, tag, pid)
+	if len(e.fields) == 0 {
+		buf.WriteString("-")
+	} else {
+		keys := make([]string, 0, len(e.fields))
+		for k := range e.fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString("[" + syslogSDID)
+		escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+		for _, k := range keys {
+			fmt.Fprintf(buf, " %s=\"%s\"", sdName(k), escaper.Replace(fmt.Sprint(e.fields[k])))
+		}
+		buf.WriteString("]")
+	}
+	buf.WriteString(" ")
+	buf.WriteString(e.msg)
+	return buf.Bytes()
+}
+
+// sdName turns k into a valid structured data parameter name.
+func sdName(k string) string {
+	b := []byte(k)
+	for i, c := range b {
+		if c <= ' ' || c >= 127 || c == '=' || c == ']' || c == '"' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 32 {
+		b = b[:32]
+	}
+	return string(b)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatRFC5424(t *testing.T) {
+	e := logEntry{
+		time:   time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC),
+		level:  levelNotice,
+		msg:    "file uploaded",
+		fields: fields{"watch": "/tmp/test", "iFile": `weird "name]`},
+	}
+	got := string(formatRFC5424(e, 3, "host", "f5-auto-uploader", 42))
+	want := `<29>1 2017-06-01T12:00:00Z host f5-auto-uploader 42 - ` +
+		`[fields@32473 iFile="weird \"name\]" watch="/tmp/test"] file uploaded`
+	if got != want {
+		t.Errorf("formatRFC5424(): got %q; want %q", got, want)
+	}
+
+	e.fields = nil
+	got = string(formatRFC5424(e, 3, "host", "", 42))
+	want = `<29>1 2017-06-01T12:00:00Z host - 42 - - file uploaded`
+	if got != want {
+		t.Errorf("formatRFC5424() without fields: got %q; want %q", got, want)
+	}
+}
+
+func TestSyslogSink_UDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer conn.Close()
+
+	sink, err := newSyslogSink("udp", conn.LocalAddr().String(), "local0", "test", levelNotice)
+	if err != nil {
+		t.Fatalf("newSyslogSink(): unexpected error %q", err.Error())
+	}
+	l := newSinkLogger(sink)
+	l.Debug("filtered out")
+	l.Error("test")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("syslogSink.write(): cannot read message: %v", err)
+	}
+	if got, want := string(buf[:4]), "<131"; got != want {
+		t.Errorf("syslogSink.write(): got priority %q; want %q", got, want)
+	}
+	if got, want := string(buf[n-5:n]), " test"; got != want {
+		t.Errorf("syslogSink.write(): got message ending with %q; want %q", got, want)
+	}
+}
+
+func TestSyslogSink_Backoff(t *testing.T) {
+	oldStderr := stderr
+	defer func() { stderr = oldStderr }()
+	buf := new(bytes.Buffer)
+	stderr = buf
+
+	sink, err := newSyslogSink("tcp", "127.0.0.1:514", "", "test", levelInfo)
+	if err != nil {
+		t.Fatalf("newSyslogSink(): unexpected error %q", err.Error())
+	}
+	var dials int
+	sink.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dials++
+		return nil, errors.New("connection refused")
+	}
+	l := newSinkLogger(sink)
+	for i := 0; i < 3; i++ {
+		l.Error("test")
+	}
+	if dials != 1 {
+		t.Errorf("syslogSink.write(): got %d dials while the relay is down; want 1", dials)
+	}
+	if sink.backoff != syslogMinBackoff {
+		t.Errorf("syslogSink.write(): got backoff %v; want %v", sink.backoff, syslogMinBackoff)
+	}
+
+	// Once the delay expired, the sink dials again and doubles the delay
+	// on failure.
+	sink.retryAt = time.Time{}
+	l.Error("test")
+	if dials != 2 || sink.backoff != 2*syslogMinBackoff {
+		t.Errorf("syslogSink.write(): got %d dials and backoff %v; want 2 and %v", dials, sink.backoff, 2*syslogMinBackoff)
+	}
+
+	// The dropped entries are reported once the relay is reachable again.
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+	sink.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return client, nil
+	}
+	sink.retryAt = time.Time{}
+	l.Error("test")
+	if want := "4 log entries were dropped"; !strings.Contains(buf.String(), want) {
+		t.Errorf("syslogSink.write(): stderr does not contain %q:\n%s", want, buf.String())
+	}
+	if sink.backoff != 0 || sink.dropped != 0 {
+		t.Errorf("syslogSink.write(): got backoff %v and %d dropped entries after reconnection; want 0", sink.backoff, sink.dropped)
+	}
+}
+
+func TestNewSyslogSink_Invalid(t *testing.T) {
+	if _, err := newSyslogSink("udp", "127.0.0.1:514", "unknown", "", levelInfo); err == nil {
+		t.Error("newSyslogSink() with unknown facility: expected error, got nil")
+	}
+	if _, err := newSyslogSink("http", "127.0.0.1:514", "", "", levelInfo); err == nil {
+		t.Error("newSyslogSink() with unsupported network: expected error, got nil")
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/e-XpertSolutions/f5-rest-client/f5"
+)
+
+// Steps of the transformation pipeline.
+const (
+	transformTemplate = "template"
+	transformMinify   = "minify"
+	transformGzip     = "gzip"
+)
+
+// source is the content uploaded to the BigIP for a local file, that is the
+// file itself or the output of the transformation pipeline.
+type source struct {
+	io.ReadSeeker
+	path     string // of the local file
+	size     int64
+	closer   io.Closer // may be nil
+	l        logger
+	uploader *uploader // may be nil
+}
+
+func (src *source) Close() error {
+	if src.closer == nil {
+		return nil
+	}
+	return src.closer.Close()
+}
+
+// upload sends the content to the BigIP under name and returns the path of
+// the file written on the BigIP.
+func (src *source) upload(c *f5.Client, name string) (string, error) {
+	u := src.uploader
+	if u == nil {
+		u = defaultUploader
+	}
+	return u.upload(c, src.l, name, src, src.size)
+}
+
+// transformer applies the transformation pipeline of a watch to the content
+// of the files before they are uploaded.
+type transformer struct {
+	steps   []string
+	vars    map[string]string
+	gzipMin int64
+}
+
+// newTransformer returns the transformer configured for the watch, or nil
+// when no transformation is configured.
+func newTransformer(cfg watchConfig) (*transformer, error) {
+	if len(cfg.Transform) == 0 {
+		return nil, nil
+	}
+	if err := checkTransformSteps(cfg.Transform); err != nil {
+		return nil, err
+	}
+	return &transformer{
+		steps:   cfg.Transform,
+		vars:    cfg.TemplateVars,
+		gzipMin: cfg.GzipMinSizeKB * 1024,
+	}, nil
+}
+
+// checkTransformSteps makes sure that the steps are known, given once, and
+// that gzip comes last since nothing can be done on compressed content.
+func checkTransformSteps(steps []string) error {
+	seen := make(map[string]bool)
+	for i, step := range steps {
+		switch step {
+		case transformTemplate, transformMinify:
+		case transformGzip:
+			if i != len(steps)-1 {
+				return fmt.Errorf("transformation %q must be the last one", step)
+			}
+		default:
+			return fmt.Errorf("unsupported transformation %q", step)
+		}
+		if seen[step] {
+			return fmt.Errorf("transformation %q given more than once", step)
+		}
+		seen[step] = true
+	}
+	return nil
+}
+
+// templateData is passed to the templates rendered by the pipeline.
+type templateData struct {
+	File string            // base name of the file
+	Vars map[string]string // template_vars of the watch
+	Env  map[string]string // environment of the process
+}
+
+func environ() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return env
+}
+
+// apply runs the pipeline on data, the content of the file located at path.
+func (t *transformer) apply(path string, data []byte) ([]byte, error) {
+	for _, step := range t.steps {
+		switch step {
+		case transformTemplate:
+			tmpl, err := template.New(filepath.Base(path)).Option("missingkey=error").Parse(string(data))
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse template %q: %v", path, err)
+			}
+			var buf bytes.Buffer
+			err = tmpl.Execute(&buf, templateData{
+				File: filepath.Base(path),
+				Vars: t.vars,
+				Env:  environ(),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("cannot render template %q: %v", path, err)
+			}
+			data = buf.Bytes()
+		case transformMinify:
+			data = minify(path, data)
+		case transformGzip:
+			if int64(len(data)) < t.gzipMin {
+				continue
+			}
+			var buf bytes.Buffer
+			// The header is left empty, without name nor time, so that
+			// the output only depends on the content.
+			zw := gzip.NewWriter(&buf)
+			if _, err := zw.Write(data); err != nil {
+				return nil, fmt.Errorf("cannot compress %q: %v", path, err)
+			}
+			if err := zw.Close(); err != nil {
+				return nil, fmt.Errorf("cannot compress %q: %v", path, err)
+			}
+			data = buf.Bytes()
+		}
+	}
+	return data, nil
+}
+
+// minify removes the whitespace and comments that do not change the meaning
+// of HTML, CSS and JavaScript files. Other files are returned unchanged. It
+// is deliberately conservative: line breaks are kept, as well as the content
+// of the <pre>, <textarea> and <script> elements and of the JavaScript
+// strings, regular expressions and template literals.
+func minify(path string, data []byte) []byte {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		return minifyHTML(data)
+	case ".css":
+		return trimLines(removeCSSComments(data))
+	case ".js":
+		return minifyJS(data)
+	}
+	return data
+}
+
+var (
+	htmlPreformattedRegexp = regexp.MustCompile(`(?is)<pre\b.*?</pre\s*>|<textarea\b.*?</textarea\s*>|<script\b.*?</script\s*>`)
+	htmlCommentRegexp      = regexp.MustCompile(`(?s)<!--.*?-->`)
+)
+
+func minifyHTML(data []byte) []byte {
+	minifyText := func(b []byte, first, last bool) []byte {
+		b = htmlCommentRegexp.ReplaceAllFunc(b, func(c []byte) []byte {
+			if bytes.HasPrefix(c, []byte("<!--[if")) {
+				return c // conditional comment
+			}
+			return nil
+		})
+		// The line breaks around the preformatted elements are kept.
+		m := trimLines(b)
+		if len(m) == 0 {
+			if !first && !last && bytes.IndexByte(b, '\n') >= 0 {
+				return []byte("\n")
+			}
+			return nil
+		}
+		if !first && bytes.IndexByte(b[:len(b)-len(bytes.TrimLeft(b, " \t\r\n"))], '\n') >= 0 {
+			m = append([]byte("\n"), m...)
+		}
+		if !last && bytes.IndexByte(b[len(bytes.TrimRight(b, " \t\r\n")):], '\n') >= 0 {
+			m = append(m, '\n')
+		}
+		return m
+	}
+	var out []byte
+	last := 0
+	for _, loc := range htmlPreformattedRegexp.FindAllIndex(data, -1) {
+		out = append(out, minifyText(data[last:loc[0]], last == 0, false)...)
+		out = append(out, data[loc[0]:loc[1]]...)
+		last = loc[1]
+	}
+	return append(out, minifyText(data[last:], last == 0, true)...)
+}
+
+// removeCSSComments removes the /* */ comments found outside of strings.
+func removeCSSComments(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	var quote byte
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && i+1 < len(data) {
+				out = append(out, c, data[i+1])
+				i++
+				continue
+			}
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return out
+			}
+			i += end + 3
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// jsRegexpKeywords lists the keywords after which a slash starts a regular
+// expression rather than a division.
+var jsRegexpKeywords = map[string]bool{
+	"return": true, "typeof": true, "case": true, "do": true, "else": true,
+	"in": true, "instanceof": true, "new": true, "delete": true, "void": true,
+	"throw": true, "yield": true, "await": true, "of": true,
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func isJSIdentChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// minifyJS removes the comments, the leading and trailing whitespace of each
+// line and the blank lines of a JavaScript file. The literals are copied
+// verbatim, as well as the /*! comments, which usually hold a license.
+func minifyJS(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	var (
+		last      byte   // last significant character of code
+		word      string // last identifier, keyword or number
+		lineStart = true // nothing but whitespace was read on the line
+	)
+	newline := func() {
+		out = bytes.TrimRight(out, " \t\r")
+		if len(out) > 0 && out[len(out)-1] != '\n' {
+			out = append(out, '\n')
+		}
+		lineStart = true
+	}
+	literal := func(end int, i int) int {
+		out = append(out, data[i:end]...)
+		last, word, lineStart = ')', "", false
+		return end
+	}
+	for i := 0; i < len(data); {
+		c := data[i]
+		var next byte
+		if i+1 < len(data) {
+			next = data[i+1]
+		}
+		switch {
+		case c == '\n':
+			newline()
+			i++
+			continue
+		case lineStart && isSpace(c):
+			i++
+			continue
+		case c == '/' && next == '/':
+			if end := bytes.IndexByte(data[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(data)
+			}
+			continue
+		case c == '/' && next == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				i = len(data)
+				continue
+			}
+			comment := data[i : i+end+4]
+			i += end + 4
+			switch {
+			case bytes.HasPrefix(comment, []byte("/*!")):
+				out = append(out, comment...)
+				lineStart = false
+			case bytes.IndexByte(comment, '\n') >= 0:
+				newline()
+			case !lineStart && isSpace(out[len(out)-1]):
+				for i < len(data) && (data[i] == ' ' || data[i] == '\t') {
+					i++
+				}
+			case !lineStart && i < len(data) && !isSpace(data[i]):
+				// The comment separates two tokens.
+				out = append(out, ' ')
+			}
+			continue
+		case c == '\'' || c == '"':
+			i = literal(jsStringEnd(data, i), i)
+			continue
+		case c == '`':
+			i = literal(jsTemplateEnd(data, i), i)
+			continue
+		case c == '/' && (last == 0 || (isJSIdentChar(last) && jsRegexpKeywords[word]) ||
+			(!isJSIdentChar(last) && last != ')' && last != ']')):
+			i = literal(jsRegexpEnd(data, i), i)
+			continue
+		}
+		if isJSIdentChar(c) {
+			if len(out) > 0 && isJSIdentChar(out[len(out)-1]) && !lineStart {
+				word += string(c)
+			} else {
+				word = string(c)
+			}
+		}
+		out = append(out, c)
+		if !isSpace(c) {
+			last = c
+		}
+		lineStart = false
+		i++
+	}
+	return out
+}
+
+// jsStringEnd returns the index following the string starting at i. An
+// unterminated string ends with the line.
+func jsStringEnd(data []byte, i int) int {
+	quote := data[i]
+	for i++; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1
+		case '\n':
+			return i
+		}
+	}
+	return len(data)
+}
+
+// jsTemplateEnd returns the index following the template literal starting at
+// i, including its substitutions.
+func jsTemplateEnd(data []byte, i int) int {
+	for i++; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '`':
+			return i + 1
+		case '$':
+			if i+1 < len(data) && data[i+1] == '{' {
+				i = jsSubstitutionEnd(data, i+2) - 1
+			}
+		}
+	}
+	return len(data)
+}
+
+// jsSubstitutionEnd returns the index following the substitution of a
+// template literal whose expression starts at i.
+func jsSubstitutionEnd(data []byte, i int) int {
+	depth := 1
+	for ; i < len(data); i++ {
+		switch data[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		case '\'', '"':
+			i = jsStringEnd(data, i) - 1
+		case '`':
+			i = jsTemplateEnd(data, i) - 1
+		}
+	}
+	return len(data)
+}
+
+// jsRegexpEnd returns the index following the regular expression starting at
+// i, without its flags. An unterminated expression ends with the line.
+func jsRegexpEnd(data []byte, i int) int {
+	inClass := false
+	for i++; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '/':
+			if !inClass {
+				return i + 1
+			}
+		case '\n':
+			return i
+		}
+	}
+	return len(data)
+}
+
+// trimLines removes the leading and trailing whitespace of each line as well
+// as the blank lines.
+func trimLines(data []byte) []byte {
+	var out []byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if out != nil {
+			out = append(out, '\n')
+		}
+		out = append(out, line...)
+	}
+	return out
+}
+
+// open returns the content to upload for the file located at path.
+func (s *syncer) open(path string) (*source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file %q: %v", path, err)
+	}
+	if s.transform == nil {
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("cannot stat file %q: %v", path, err)
+		}
+		return &source{ReadSeeker: f, path: path, size: fi.Size(), closer: f, l: s.l, uploader: s.uploader}, nil
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read file %q: %v", path, err)
+	}
+	if data, err = s.transform.apply(path, data); err != nil {
+		return nil, err
+	}
+	return &source{ReadSeeker: bytes.NewReader(data), path: path, size: int64(len(data)), l: s.l, uploader: s.uploader}, nil
+}
+
+// checksum returns the digest of the content uploaded for the file located
+// at path. The digests of the transformed content are not cached since they
+// also depend on the configuration and the environment.
+func (s *syncer) checksum(path, algo string) (string, error) {
+	if s.transform == nil {
+		return s.cache.checksum(path, algo)
+	}
+	src, err := s.open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	h, err := newHash(algo)
+	if err != nil {
+		return "", fmt.Errorf("%v for file %q", err, path)
+	}
+	if _, err := io.Copy(h, src); err != nil {
+		return "", fmt.Errorf("cannot write file %q into hash function of type %q: %v", path, algo, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
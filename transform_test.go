@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMinifyJS(t *testing.T) {
+	in := "/*! license */\n" +
+		"// header\n" +
+		"var url = \"http://example.com\"; // trailing\n" +
+		"  var re = /\\/\\*not a comment/g, half = a / 2 / b;\n" +
+		"\n" +
+		"  /* block\n     comment */\n" +
+		"  var tpl = `line\n    // kept ${ f(\"}\") + `nested\n      ${x}` } /* kept */`;\n" +
+		"  function test(s) { return /a\\/b[/]/.test(s); /* inline */ }\n"
+	want := "/*! license */\n" +
+		"var url = \"http://example.com\";\n" +
+		"var re = /\\/\\*not a comment/g, half = a / 2 / b;\n" +
+		"var tpl = `line\n    // kept ${ f(\"}\") + `nested\n      ${x}` } /* kept */`;\n" +
+		"function test(s) { return /a\\/b[/]/.test(s); }\n"
+	if got := string(minifyJS([]byte(in))); got != want {
+		t.Errorf("minifyJS(%q):\ngot  %q\nwant %q", in, got, want)
+	}
+}
+
+func TestTransformerApply(t *testing.T) {
+	os.Setenv("F5_AUTO_UPLOADER_TEST_ENV", "prod")
+	defer os.Unsetenv("F5_AUTO_UPLOADER_TEST_ENV")
+
+	tests := []struct {
+		steps []string
+		path  string
+		in    string
+		want  string
+	}{
+		{
+			[]string{"template"},
+			"index.html",
+			`<p>{{.Vars.backend}} ({{.Env.F5_AUTO_UPLOADER_TEST_ENV}}, {{.File}})</p>`,
+			`<p>https://api.example.com (prod, index.html)</p>`,
+		},
+		{
+			[]string{"minify"},
+			"index.html",
+			"<html>\n  <!-- comment -->\n  <body>\n\n    <p>text</p>\n<pre>\n  keep\n</pre>\n  </body>\n</html>\n",
+			"<html>\n<body>\n<p>text</p>\n<pre>\n  keep\n</pre>\n</body>\n</html>",
+		},
+		{
+			[]string{"minify"},
+			"style.css",
+			"/* header */\nbody {\n  content: \"/* not a comment */\";\n}\n",
+			"body {\ncontent: \"/* not a comment */\";\n}",
+		},
+		{
+			[]string{"minify"},
+			"data.bin",
+			"  keep\n\n  as is\n",
+			"  keep\n\n  as is\n",
+		},
+		{
+			[]string{"template", "minify"},
+			"app.js",
+			"  var env = \"{{.Vars.env}}\";\n  var msg = `line\n    indented`;\n",
+			"var env = \"staging\";\nvar msg = `line\n    indented`;\n",
+		},
+		{
+			[]string{"minify"},
+			"index.html",
+			"<body>\n  <script>\n    var msg = `line\n      indented`;\n  </script>\n  <p>text</p>\n</body>\n",
+			"<body>\n<script>\n    var msg = `line\n      indented`;\n  </script>\n<p>text</p>\n</body>",
+		},
+	}
+	for _, test := range tests {
+		tr, err := newTransformer(watchConfig{
+			Transform:    test.steps,
+			TemplateVars: map[string]string{"backend": "https://api.example.com", "env": "staging"},
+		})
+		if err != nil {
+			t.Fatalf("newTransformer(%v): unexpected error %q", test.steps, err.Error())
+		}
+		got, err := tr.apply(test.path, []byte(test.in))
+		if err != nil {
+			t.Errorf("apply(%v, %q): unexpected error %q", test.steps, test.path, err.Error())
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("apply(%v, %q): got %q; want %q", test.steps, test.path, got, test.want)
+		}
+	}
+
+	tr, _ := newTransformer(watchConfig{Transform: []string{"template"}})
+	if _, err := tr.apply("index.html", []byte("{{.Vars.missing}}")); err == nil {
+		t.Error("apply: expected error for missing template variable, got nil")
+	}
+}
+
+func TestTransformerGzip(t *testing.T) {
+	tr, err := newTransformer(watchConfig{Transform: []string{"gzip"}, GzipMinSizeKB: 1})
+	if err != nil {
+		t.Fatalf("newTransformer: unexpected error %q", err.Error())
+	}
+	small := []byte("small")
+	if got, _ := tr.apply("small.js", small); !bytes.Equal(got, small) {
+		t.Errorf("apply(small.js): got %q; want %q", got, small)
+	}
+
+	large := bytes.Repeat([]byte("large content\n"), 100)
+	got, err := tr.apply("large.js", large)
+	if err != nil {
+		t.Fatalf("apply(large.js): unexpected error %q", err.Error())
+	}
+	again, _ := tr.apply("large.js", large)
+	if !bytes.Equal(got, again) {
+		t.Error("apply(large.js): output is not deterministic")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(got))
+	if err != nil {
+		t.Fatalf("apply(large.js): output is not gzipped: %v", err)
+	}
+	if data, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(data, large) {
+		t.Errorf("apply(large.js): cannot decompress output: %v", err)
+	}
+}
+
+func TestCheckTransformSteps(t *testing.T) {
+	for _, steps := range [][]string{nil, {"template"}, {"template", "minify", "gzip"}} {
+		if err := checkTransformSteps(steps); err != nil {
+			t.Errorf("checkTransformSteps(%v): unexpected error %q", steps, err.Error())
+		}
+	}
+	for _, steps := range [][]string{{"uglify"}, {"gzip", "minify"}, {"minify", "minify"}} {
+		if err := checkTransformSteps(steps); err == nil {
+			t.Errorf("checkTransformSteps(%v): expected error, got nil", steps)
+		}
+	}
+}
+
+func TestSyncerChecksumTransformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index.html")
+	if err := ioutil.WriteFile(path, []byte("<p>{{.Vars.name}}</p>"), 0644); err != nil {
+		t.Fatal("setup: ", err)
+	}
+
+	env := syncEnv{target: "https://bigip", l: discardLogger{}}
+	s, err := newSyncer(env, watchConfig{
+		Dir:          dir,
+		Transform:    []string{"template"},
+		TemplateVars: map[string]string{"name": "world"},
+	})
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	sum := sha1.Sum([]byte("<p>world</p>"))
+	want := hex.EncodeToString(sum[:])
+	got, err := s.checksum(path, "SHA1")
+	if err != nil {
+		t.Fatalf("checksum(%q): unexpected error %q", path, err.Error())
+	}
+	if got != want {
+		t.Errorf("checksum(%q): got %q; want %q", path, got, want)
+	}
+
+	src, err := s.open(path)
+	if err != nil {
+		t.Fatalf("open(%q): unexpected error %q", path, err.Error())
+	}
+	defer src.Close()
+	data, _ := ioutil.ReadAll(src)
+	if string(data) != "<p>world</p>" || src.size != int64(len(data)) {
+		t.Errorf("open(%q): got %q (size %d); want %q", path, data, src.size, "<p>world</p>")
+	}
+}
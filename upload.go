@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/e-XpertSolutions/f5-rest-client/f5"
+)
+
+const (
+	// fileTransferPath is the iControl REST endpoint receiving the uploaded
+	// files, which are written into fileTransferDir.
+	fileTransferPath = "/mgmt/shared/file-transfer/uploads/"
+
+	// maxChunkSize is the largest chunk accepted by the file-transfer
+	// endpoint, also used by default.
+	maxChunkSize = 1 << 20
+
+	defaultChunkRetries    = 3
+	defaultChunkRetryDelay = time.Second
+)
+
+// uploader sends files to the BigIP in chunks through the file-transfer
+// endpoint. Each chunk is retried on its own with an exponential backoff.
+// When a chunk ultimately fails, the offset acknowledged so far is kept so
+// that the next upload of the same content resumes from there.
+type uploader struct {
+	chunkSize int64
+	retries   int
+	delay     time.Duration // before the first retry of a chunk, doubled after each attempt
+
+	mu       sync.Mutex
+	progress map[string]uploadProgress // by remote file name
+}
+
+// uploadProgress is the state of an interrupted upload.
+type uploadProgress struct {
+	digest string // SHA1 of the content being uploaded
+	offset int64  // number of bytes acknowledged by the BigIP
+}
+
+func newUploader(cfg uploadConfig) *uploader {
+	u := &uploader{
+		chunkSize: cfg.ChunkSizeKB * 1024,
+		retries:   cfg.ChunkRetries,
+		delay:     cfg.RetryDelay.Duration,
+		progress:  make(map[string]uploadProgress),
+	}
+	if u.chunkSize <= 0 || u.chunkSize > maxChunkSize {
+		u.chunkSize = maxChunkSize
+	}
+	if u.delay <= 0 {
+		u.delay = defaultChunkRetryDelay
+	}
+	return u
+}
+
+// defaultUploader is used by the sources that are not given any uploader.
+var defaultUploader = newUploader(uploadConfig{ChunkRetries: defaultChunkRetries})
+
+// upload sends the size bytes read from r to the BigIP under name and returns
+// the path of the file written on the BigIP.
+func (u *uploader) upload(c *f5.Client, l logger, name string, r io.ReadSeeker, size int64) (string, error) {
+	if size <= 0 {
+		return "", errors.New("cannot upload empty content")
+	}
+	h := sha1.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("cannot read content: %v", err)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	var offset int64
+	u.mu.Lock()
+	if p, ok := u.progress[name]; ok && p.digest == digest && p.offset < size {
+		offset = p.offset
+	}
+	delete(u.progress, name)
+	u.mu.Unlock()
+	if offset > 0 {
+		l.Noticef("resuming upload of %q at offset %d", name, offset)
+	}
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return "", fmt.Errorf("cannot read content: %v", err)
+	}
+
+	chunked := size > u.chunkSize
+	buf := make([]byte, u.chunkSize)
+	var localPath string
+	for offset < size {
+		chunk := buf
+		if rest := size - offset; rest < int64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return "", fmt.Errorf("cannot read content: %v", err)
+		}
+		p, err := u.sendChunk(c, l, name, chunk, offset, size)
+		if err != nil {
+			if offset > 0 {
+				u.mu.Lock()
+				u.progress[name] = uploadProgress{digest: digest, offset: offset}
+				u.mu.Unlock()
+			}
+			return "", fmt.Errorf("cannot upload bytes %d-%d: %v", offset, offset+int64(len(chunk))-1, err)
+		}
+		localPath = p
+		offset += int64(len(chunk))
+		if chunked {
+			l.Infof("uploaded %d of %d bytes of %q (%d%%)", offset, size, name, offset*100/size)
+		}
+	}
+	if localPath == "" {
+		return "", fmt.Errorf("cannot upload %q: the BigIP did not report the path of the file", name)
+	}
+	return localPath, nil
+}
+
+// sendChunk sends chunk, located at offset, retrying on network and server
+// errors. It returns the path of the file on the BigIP as reported in the
+// acknowledgement of the chunk.
+func (u *uploader) sendChunk(c *f5.Client, l logger, name string, chunk []byte, offset, size int64) (string, error) {
+	delay := u.delay
+	for attempt := 0; ; attempt++ {
+		localPath, retry, err := u.post(c, name, chunk, offset, size)
+		if err == nil || !retry || attempt >= u.retries {
+			return localPath, err
+		}
+		l.Warnf("cannot upload bytes %d-%d of %q, retrying in %v: %v", offset, offset+int64(len(chunk))-1, name, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post sends a single chunk. It reports whether the request may be retried on
+// failure.
+func (u *uploader) post(c *f5.Client, name string, chunk []byte, offset, size int64) (string, bool, error) {
+	req, err := c.MakeRequest("POST", fileTransferPath+name, nil)
+	if err != nil {
+		return "", false, err
+	}
+	// The file-transfer endpoint is not part of the transactions.
+	req.Header.Del("X-F5-REST-Coordination-Id")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d/%d", offset, offset+int64(len(chunk))-1, size))
+	req.Body = ioutil.NopCloser(bytes.NewReader(chunk))
+	req.ContentLength = int64(len(chunk))
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", true, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return "", retry, fmt.Errorf("unexpected status %q: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var ack struct {
+		LocalFilePath string `json:"localFilePath"`
+	}
+	if err := json.Unmarshal(body, &ack); err != nil {
+		return "", false, fmt.Errorf("cannot decode acknowledgement: %v", err)
+	}
+	return ack.LocalFilePath, false, nil
+}
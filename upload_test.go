@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/e-XpertSolutions/f5-rest-client/f5"
+)
+
+// fileTransferStub mimics the file-transfer endpoint of the BigIP. It fails
+// the chunks starting at the offsets listed in fail, once per listed status,
+// and acknowledges the chunks starting at the offsets listed in acks with the
+// given body.
+type fileTransferStub struct {
+	mu     sync.Mutex
+	files  map[string][]byte
+	ranges []string
+	fail   map[int64][]int
+	acks   map[int64]string
+}
+
+func newFileTransferStub() *fileTransferStub {
+	return &fileTransferStub{
+		files: make(map[string][]byte),
+		fail:  make(map[int64][]int),
+		acks:  make(map[int64]string),
+	}
+}
+
+func (fts *fileTransferStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fts.mu.Lock()
+	defer fts.mu.Unlock()
+	if !strings.HasPrefix(r.URL.Path, fileTransferPath) || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("X-F5-REST-Coordination-Id") != "" {
+		http.Error(w, "uploads are not part of transactions", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, fileTransferPath)
+	rng := r.Header.Get("Content-Range")
+	fts.ranges = append(fts.ranges, rng)
+	var start, end, total int64
+	if _, err := fmt.Sscanf(rng, "%d-%d/%d", &start, &end, &total); err != nil {
+		http.Error(w, "invalid range", http.StatusBadRequest)
+		return
+	}
+	if statuses := fts.fail[start]; len(statuses) > 0 {
+		fts.fail[start] = statuses[1:]
+		http.Error(w, "failure", statuses[0])
+		return
+	}
+	data, _ := ioutil.ReadAll(r.Body)
+	if int64(len(data)) != end-start+1 {
+		http.Error(w, "invalid length", http.StatusBadRequest)
+		return
+	}
+	file := fts.files[name]
+	if int64(len(file)) < start {
+		http.Error(w, "missing chunk", http.StatusBadRequest)
+		return
+	}
+	fts.files[name] = append(file[:start], data...)
+	if ack, ok := fts.acks[start]; ok {
+		fmt.Fprint(w, ack)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"remainingByteCount": total - end - 1,
+		"totalByteCount":     total,
+		"localFilePath":      "/var/config/rest/downloads/" + name,
+	})
+}
+
+func (fts *fileTransferStub) reset() {
+	fts.mu.Lock()
+	fts.ranges = nil
+	fts.mu.Unlock()
+}
+
+func TestUploaderChunks(t *testing.T) {
+	fts := newFileTransferStub()
+	ts := httptest.NewServer(fts)
+	defer ts.Close()
+	c, err := f5.NewBasicClient(ts.URL, "admin", "admin")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	tx, err := c.Begin()
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+
+	u := newUploader(uploadConfig{ChunkSizeKB: 4, ChunkRetries: 2, RetryDelay: duration{time.Millisecond}})
+	content := bytes.Repeat([]byte("0123456789"), 1024)
+	fts.fail[4096] = []int{http.StatusServiceUnavailable}
+
+	localPath, err := u.upload(tx, discardLogger{}, "large.html", bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatalf("upload: unexpected error %q", err.Error())
+	}
+	if want := "/var/config/rest/downloads/large.html"; localPath != want {
+		t.Errorf("upload: got path %q; want %q", localPath, want)
+	}
+	if !bytes.Equal(fts.files["large.html"], content) {
+		t.Error("upload: uploaded content differs from the local one")
+	}
+	wantRanges := []string{"0-4095/10240", "4096-8191/10240", "4096-8191/10240", "8192-10239/10240"}
+	if strings.Join(fts.ranges, ",") != strings.Join(wantRanges, ",") {
+		t.Errorf("upload: got ranges %q; want %q", fts.ranges, wantRanges)
+	}
+
+	// Client errors are not retried.
+	fts.reset()
+	fts.fail[0] = []int{http.StatusUnauthorized}
+	if _, err := u.upload(c, discardLogger{}, "small.html", bytes.NewReader(content[:10]), 10); err == nil {
+		t.Fatal("upload: expected error, got nil")
+	}
+	if len(fts.ranges) != 1 {
+		t.Errorf("upload: got %d requests; want 1", len(fts.ranges))
+	}
+}
+
+func TestUploaderResume(t *testing.T) {
+	fts := newFileTransferStub()
+	ts := httptest.NewServer(fts)
+	defer ts.Close()
+	c, err := f5.NewBasicClient(ts.URL, "admin", "admin")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+
+	u := newUploader(uploadConfig{ChunkSizeKB: 4, ChunkRetries: 1, RetryDelay: duration{time.Millisecond}})
+	content := bytes.Repeat([]byte("abcdefghij"), 1024)
+	fts.fail[8192] = []int{http.StatusInternalServerError, http.StatusInternalServerError}
+	if _, err := u.upload(c, discardLogger{}, "large.js", bytes.NewReader(content), int64(len(content))); err == nil {
+		t.Fatal("upload: expected error, got nil")
+	}
+
+	// The same content resumes from the last acknowledged offset.
+	fts.reset()
+	if _, err := u.upload(c, discardLogger{}, "large.js", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("upload: unexpected error %q", err.Error())
+	}
+	if len(fts.ranges) == 0 || fts.ranges[0] != "8192-10239/10240" {
+		t.Errorf("upload: got ranges %q; want to resume at 8192", fts.ranges)
+	}
+	if !bytes.Equal(fts.files["large.js"], content) {
+		t.Error("upload: uploaded content differs from the local one")
+	}
+
+	// Other content starts over.
+	fts.fail[8192] = []int{http.StatusInternalServerError, http.StatusInternalServerError}
+	u.upload(c, discardLogger{}, "large.js", bytes.NewReader(content), int64(len(content)))
+	fts.reset()
+	other := bytes.Repeat([]byte("ABCDEFGHIJ"), 1024)
+	if _, err := u.upload(c, discardLogger{}, "large.js", bytes.NewReader(other), int64(len(other))); err != nil {
+		t.Fatalf("upload: unexpected error %q", err.Error())
+	}
+	if len(fts.ranges) == 0 || fts.ranges[0] != "0-4095/10240" {
+		t.Errorf("upload: got ranges %q; want to start at 0", fts.ranges)
+	}
+	if !bytes.Equal(fts.files["large.js"], other) {
+		t.Error("upload: uploaded content differs from the local one")
+	}
+}
+
+func TestUploaderInvalidAck(t *testing.T) {
+	fts := newFileTransferStub()
+	ts := httptest.NewServer(fts)
+	defer ts.Close()
+	c, err := f5.NewBasicClient(ts.URL, "admin", "admin")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+
+	u := newUploader(uploadConfig{ChunkSizeKB: 4, ChunkRetries: 1, RetryDelay: duration{time.Millisecond}})
+	content := []byte("0123456789")
+	for _, ack := range []string{"not json", `{"remainingByteCount":0,"totalByteCount":10}`} {
+		fts.acks[0] = ack
+		if _, err := u.upload(c, discardLogger{}, "index.html", bytes.NewReader(content), int64(len(content))); err == nil {
+			t.Errorf("upload with acknowledgement %q: expected error, got nil", ack)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// configErrors lists the problems found in the configuration files, each of
+// them prefixed by the file and the path of the offending key.
+type configErrors []string
+
+func (errs configErrors) Error() string {
+	return "invalid configuration file:\n\t" + strings.Join(errs, "\n\t")
+}
+
+func (errs *configErrors) add(key, format string, v ...interface{}) {
+	*errs = append(*errs, key+": "+fmt.Sprintf(format, v...))
+}
+
+// addUndecoded reports the keys of the configuration file which do not match
+// any setting.
+func (errs *configErrors) addUndecoded(file string, md toml.MetaData) {
+	var undecoded []string
+	for _, key := range md.Undecoded() {
+		undecoded = append(undecoded, key.String())
+	}
+	sort.Strings(undecoded)
+	for _, key := range undecoded {
+		errs.add(file+": "+key, "unknown key")
+	}
+}
+
+// validateConfig checks cfg and reports all the problems found at once, along
+// with the ones already found while decoding the configuration files.
+func validateConfig(cfg *config, errs configErrors) error {
+	file := cfg.path + ": "
+	validateF5Config(&errs, file, cfg)
+	validateLogConfig(&errs, file, cfg.Log)
+	if cfg.Audit.MaxSizeMB < 0 {
+		errs.add(file+"audit.max_size_mb", "must not be negative")
+	}
+	if cfg.Audit.MaxBackups < 0 {
+		errs.add(file+"audit.max_backups", "must not be negative")
+	}
+	if cfg.Upload.ChunkSizeKB <= 0 || cfg.Upload.ChunkSizeKB > maxChunkSize/1024 {
+		errs.add(file+"upload.chunk_size_kb", "must be between 1 and %d", maxChunkSize/1024)
+	}
+	if cfg.Upload.ChunkRetries < 0 {
+		errs.add(file+"upload.chunk_retries", "must not be negative")
+	}
+	if cfg.Upload.RetryDelay.Duration < 0 {
+		errs.add(file+"upload.retry_delay", "must not be negative")
+	}
+	if cfg.Control.Listen != "" {
+		if err := checkControlListen(cfg.Control.Listen); err != nil {
+			errs.add(file+"control.listen", "%v", err)
+		}
+	}
+	if cfg.Metrics.Listen != "" && !strings.HasPrefix(cfg.Metrics.Path, "/") {
+		errs.add(file+"metrics.path", "must start with a slash")
+	}
+	for i, n := range cfg.Notify {
+		key := cfg.key("notify", i)
+		if n.URL == "" {
+			errs.add(key+".url", "missing value")
+		} else if err := checkURL(n.URL); err != nil {
+			errs.add(key+".url", "%v", err)
+		}
+		switch n.Type {
+		case "", "generic", "slack", "teams":
+		default:
+			errs.add(key+".type", "unsupported notification type %q", n.Type)
+		}
+		for _, event := range n.Events {
+			if event != notifyDeployed && event != notifyFailed {
+				errs.add(key+".events", "unsupported notification event %q", event)
+			}
+		}
+	}
+	for i, w := range cfg.Watch {
+		key := cfg.key("watch", i)
+		if _, err := lookupHandler(w.Type); err != nil {
+			errs.add(key+".type", "%v", err)
+		}
+		checkDir(&errs, key+".directory", w.Dir)
+		checkPatterns(&errs, key+".include", w.Include, true)
+		checkPatterns(&errs, key+".exclude", w.Exclude, true)
+		if w.Debounce.Duration < 0 {
+			errs.add(key+".debounce", "must not be negative")
+		}
+		if w.HookTimeout.Duration < 0 {
+			errs.add(key+".hook_timeout", "must not be negative")
+		}
+		if err := checkTransformSteps(w.Transform); err != nil {
+			errs.add(key+".transform", "%v", err)
+		}
+		if w.GzipMinSizeKB < 0 {
+			errs.add(key+".gzip_min_size_kb", "must not be negative")
+		}
+		if w.ScanWorkers < 0 {
+			errs.add(key+".scan_workers", "must not be negative")
+		}
+		if w.MaxSizeKB < 0 {
+			errs.add(key+".max_size_kb", "must not be negative")
+		}
+		for j, ext := range w.AllowedExtensions {
+			if ext == "" || ext == "." || strings.ContainsAny(ext, `/\`) {
+				errs.add(fmt.Sprintf("%s.allowed_extensions[%d]", key, j), "invalid extension %q", ext)
+			}
+		}
+		for j, typ := range w.AllowedTypes {
+			if _, err := path.Match(typ, ""); err != nil || strings.Count(typ, "/") != 1 {
+				errs.add(fmt.Sprintf("%s.allowed_types[%d]", key, j), "invalid media type %q, must be like \"text/*\"", typ)
+			}
+		}
+	}
+	for i, x := range cfg.ILX {
+		key := cfg.key("ilx", i)
+		checkDir(&errs, key+".directory", x.Dir)
+		if !objectNameRegexp.MatchString(x.Workspace) {
+			errs.add(key+".workspace", "invalid workspace name %q", x.Workspace)
+		}
+		if !objectNameRegexp.MatchString(x.Extension) {
+			errs.add(key+".extension", "invalid extension name %q", x.Extension)
+		}
+		if x.Plugin != "" && !objectNameRegexp.MatchString(x.Plugin) {
+			errs.add(key+".plugin", "invalid plugin name %q", x.Plugin)
+		}
+		checkPatterns(&errs, key+".include", x.Include, false)
+		checkPatterns(&errs, key+".exclude", x.Exclude, false)
+		if x.Debounce.Duration < 0 {
+			errs.add(key+".debounce", "must not be negative")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateF5Config(errs *configErrors, file string, cfg *config) {
+	if cfg.F5.URL == "" {
+		errs.add(file+"f5.url", "missing value")
+	} else if err := checkURL(cfg.F5.URL); err != nil {
+		errs.add(file+"f5.url", "%v", err)
+	}
+	switch cfg.F5.AuthMethod {
+	case "basic", "token":
+	case "":
+		errs.add(file+"f5.auth_method", "missing value, must be \"basic\" or \"token\"")
+	default:
+		errs.add(file+"f5.auth_method", "unsupported auth method %q, must be \"basic\" or \"token\"", cfg.F5.AuthMethod)
+	}
+	switch cfg.CredentialStorage {
+	case "plain":
+		if cfg.F5.User == "" {
+			errs.add(file+"f5.user", "missing value")
+		}
+	case "secret":
+		if cfg.SecretStorePath == "" {
+			errs.add(file+"secret_store_path", "missing value")
+		}
+	default:
+		errs.add(file+"credential_storage", "unsupported credential storage %q, must be \"plain\" or \"secret\"", cfg.CredentialStorage)
+	}
+}
+
+func validateLogConfig(errs *configErrors, file string, cfg logConfig) {
+	if _, err := parseLevel(cfg.Level); err != nil {
+		errs.add(file+"log.level", "%v", err)
+	}
+	checkLogFormat(errs, file+"log.format", cfg.Format)
+	for i, s := range cfg.Sinks {
+		key := fmt.Sprintf("%slog.sink[%d]", file, i)
+		switch s.Type {
+		case "", "stderr", "journald":
+		case "syslog":
+			if _, ok := syslogFacilities[s.Facility]; s.Facility != "" && !ok {
+				errs.add(key+".facility", "unknown syslog facility %q", s.Facility)
+			}
+		default:
+			errs.add(key+".type", "unsupported type %q", s.Type)
+		}
+		if _, err := parseLevel(s.Level); err != nil {
+			errs.add(key+".level", "%v", err)
+		}
+		checkLogFormat(errs, key+".format", s.Format)
+	}
+}
+
+func checkLogFormat(errs *configErrors, key, format string) {
+	if format != "" && format != "text" && format != "json" {
+		errs.add(key, "unknown log format %q, must be \"text\" or \"json\"", format)
+	}
+}
+
+func checkURL(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q, must be an absolute http or https url", rawurl)
+	}
+	return nil
+}
+
+// checkControlListen makes sure that the control API, which is not
+// authenticated, is only reachable from the host: it must listen either on a
+// unix socket or on a loopback address.
+func checkControlListen(addr string) error {
+	network, address := listenAddr(addr)
+	if network == "unix" {
+		if address == "" {
+			return errors.New("missing unix socket path")
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("invalid address %q, must be a loopback address or a unix socket", addr)
+	}
+	return nil
+}
+
+// checkDir checks that dir is an existing and readable directory.
+func checkDir(errs *configErrors, key, dir string) {
+	if dir == "" {
+		errs.add(key, "missing value")
+		return
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		errs.add(key, "cannot open directory: %v", err)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		errs.add(key, "cannot stat directory: %v", err)
+		return
+	}
+	if !fi.IsDir() {
+		errs.add(key, "%q is not a directory", dir)
+		return
+	}
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		errs.add(key, "cannot read directory: %v", err)
+	}
+}
+
+// checkPatterns checks the syntax of the gitignore-style patterns. When flat
+// is true, the patterns matching sub-directories are rejected as well.
+func checkPatterns(errs *configErrors, key string, patterns []string, flat bool) {
+	for i, p := range patterns {
+		r, err := compileRule(p)
+		if err == nil && r != nil && flat {
+			err = r.checkFlat()
+		}
+		if err != nil {
+			errs.add(fmt.Sprintf("%s[%d]", key, i), "%v", err)
+		}
+	}
+}
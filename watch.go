@@ -1,13 +1,18 @@
 package main
 
 import (
-	"fmt"
+	"os"
 	"path/filepath"
+	"sort"
+	"time"
 
-	"github.com/e-XpertSolutions/f5-rest-client/f5"
 	fsnotify "gopkg.in/fsnotify.v1"
 )
 
+// defaultDebounceDelay is the quiet period used when no debounce delay is
+// given in the configuration file.
+const defaultDebounceDelay = 500 * time.Millisecond
+
 type watchEvent fsnotify.Event
 
 func (e watchEvent) isCreate() bool {
@@ -30,80 +35,209 @@ func (e watchEvent) isChmod() bool {
 	return e.Op&fsnotify.Chmod == fsnotify.Chmod
 }
 
+// watchRoutine watches a directory, and optionally its whole sub-tree, and
+// hands the received events over to a callback function in debounced batches:
+// events are accumulated per file until nothing happened for the configured
+// delay.
 type watchRoutine struct {
-	watcher *fsnotify.Watcher
-	stopCh  chan struct{}
+	watcher   *fsnotify.Watcher
+	root      string
+	recursive bool
+	filter    *fileFilter // may be nil
+	delay     time.Duration
+	l         logger
+	retries   *retryQueue // optional
+	handle    func([]watchEvent)
+	pending   map[string]fsnotify.Op
+	stopCh    chan struct{}
+	doneCh    chan struct{} // closed when the routine exits
 }
 
-func watchDir(f5Client *f5.Client, l logger, cfg watchConfig) (*watchRoutine, error) {
+func newWatchRoutine(root string, recursive bool, filter *fileFilter, delay time.Duration, l logger, retries *retryQueue, handle func([]watchEvent)) (*watchRoutine, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
 	}
-	stopCh := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case event := <-watcher.Events:
-				e := watchEvent(event)
-				if e.isChmod() {
-					continue
-				}
-
-				fmt.Printf("testing %q against %v", e.Name, cfg.Exclude)
-				if isExcluded(filepath.Base(e.Name), cfg.Exclude) {
-					l.Noticef("skipping %q due to an exclusion pattern defined in the configuration file", e.Name)
-					continue
-				}
+	if delay <= 0 {
+		delay = defaultDebounceDelay
+	}
+	wr := &watchRoutine{
+		watcher:   watcher,
+		root:      root,
+		recursive: recursive,
+		filter:    filter,
+		delay:     delay,
+		l:         l,
+		retries:   retries,
+		handle:    handle,
+		pending:   make(map[string]fsnotify.Op),
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+	if recursive {
+		err = wr.addTree(root, false)
+	} else {
+		err = watcher.Add(root)
+	}
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go wr.run()
+	return wr, nil
+}
 
-				tx, err := f5Client.Begin()
-				if err != nil {
-					l.Errorf("cannot start f5 transaction for file %q", e.Name)
-					continue
-				}
+// addTree adds a watch on dir and on all of its sub-directories. When
+// markFiles is true, the regular files found along the way are queued as
+// created since they may have been written before the watch was in place.
+func (wr *watchRoutine) addTree(dir string, markFiles bool) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && wr.filter.skip(path, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			return wr.watcher.Add(path)
+		}
+		if markFiles && fi.Mode().IsRegular() {
+			wr.pending[path] |= fsnotify.Create
+		}
+		return nil
+	})
+}
 
-				switch {
-				case e.isCreate():
-					l.Noticef("event received %q for file %q", "CREATE", e.Name)
-					err = uploadNewFile(tx, filepath.Base(e.Name), e.Name)
-				case e.isWrite():
-					l.Noticef("event received %q for file %q", "WRITE", e.Name)
-					err = uploadExistingFile(tx, filepath.Base(e.Name), e.Name)
-				case e.isRename():
-					l.Noticef("event received %q for file %q", "RENAME", e.Name)
-					err = deleteFile(tx, filepath.Base(e.Name))
-				case e.isRemove():
-					if !cfg.RemoveRemoveFiles {
+func (wr *watchRoutine) run() {
+	defer close(wr.doneCh)
+	var (
+		timer   *time.Timer
+		timerCh <-chan time.Time
+		retryCh <-chan time.Time
+	)
+	if wr.retries != nil {
+		ticker := time.NewTicker(retryCheckInterval)
+		defer ticker.Stop()
+		retryCh = ticker.C
+	}
+	for {
+		select {
+		case event, ok := <-wr.watcher.Events:
+			if !ok {
+				return
+			}
+			e := watchEvent(event)
+			if e.isChmod() {
+				continue
+			}
+			if wr.recursive && e.isCreate() {
+				if fi, err := os.Lstat(e.Name); err == nil && fi.IsDir() {
+					if wr.filter.skip(e.Name, true) {
 						continue
 					}
-					l.Noticef("event received %q for file %q", "REMOVE", e.Name)
-					err = deleteFile(tx, filepath.Base(e.Name))
-				}
-				if err != nil {
-					l.Errorf("cannot upload file %q: %v", e.Name, err)
-					continue
+					if err := wr.addTree(e.Name, true); err != nil {
+						wr.l.Errorf("cannot watch directory %q: %v", e.Name, err)
+					}
 				}
-
-				if err := tx.Commit(); err != nil {
-					l.Errorf("cannot commit f5 transaction for file %q: %v", e.Name, err)
+			}
+			wr.pending[e.Name] |= e.Op
+			if timer == nil {
+				timer = time.NewTimer(wr.delay)
+			} else {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
 				}
-			case err := <-watcher.Errors:
-				l.Error("watcher error: ", err)
-			case <-stopCh:
+				timer.Reset(wr.delay)
+			}
+			timerCh = timer.C
+		case <-timerCh:
+			timerCh = nil
+			events := resolveEvents(wr.pending)
+			wr.pending = make(map[string]fsnotify.Op)
+			if len(events) > 0 {
+				wr.handle(events)
+			}
+		case now := <-retryCh:
+			if events := wr.retries.due(now); len(events) > 0 {
+				wr.handle(events)
+			}
+		case err, ok := <-wr.watcher.Errors:
+			if !ok {
 				return
 			}
+			wr.l.Error("watcher error: ", err)
+			stats.observeWatcherError(wr.root)
+		case <-wr.stopCh:
+			return
 		}
-	}()
-	if err := watcher.Add(cfg.Dir); err != nil {
-		stopCh <- struct{}{}
-		return nil, err
 	}
-	return &watchRoutine{
-		watcher: watcher,
-		stopCh:  stopCh,
-	}, nil
 }
 
+// resolveEvents turns the operations accumulated for each file into a single
+// event per file, sorted by name. The current state of the file system is
+// used to settle conflicting operations: a file that no longer exists is
+// reported as removed (or skipped if it was also created in the meantime)
+// while a file that exists is reported as created or written.
+// Directories are ignored.
+func resolveEvents(pending map[string]fsnotify.Op) []watchEvent {
+	names := make([]string, 0, len(pending))
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	events := make([]watchEvent, 0, len(names))
+	for _, name := range names {
+		op := pending[name]
+		fi, err := os.Lstat(name)
+		switch {
+		case err != nil:
+			if op&fsnotify.Create == fsnotify.Create {
+				continue
+			}
+			op &= fsnotify.Remove | fsnotify.Rename
+			if op == 0 {
+				op = fsnotify.Remove
+			}
+		case fi.IsDir():
+			continue
+		default:
+			op &^= fsnotify.Remove | fsnotify.Rename
+			if op&fsnotify.Create == fsnotify.Create {
+				op = fsnotify.Create
+			} else {
+				op = fsnotify.Write
+			}
+		}
+		events = append(events, watchEvent{Name: name, Op: op})
+	}
+	return events
+}
+
+// alive reports whether the routine is still running.
+func (wr *watchRoutine) alive() bool {
+	select {
+	case <-wr.doneCh:
+		return false
+	default:
+		return true
+	}
+}
+
+// stop stops the routine and waits for the changes being applied, if any.
 func (wr *watchRoutine) stop() error {
-	return wr.watcher.Close()
+	close(wr.stopCh)
+	err := wr.watcher.Close()
+	<-wr.doneCh
+	return err
+}
+
+func watchDir(s *syncer) (*watchRoutine, error) {
+	return newWatchRoutine(s.cfg.Dir, false, s.filter, s.cfg.Debounce.Duration, s.l, s.retries, s.syncEvents)
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fsnotify "gopkg.in/fsnotify.v1"
+)
+
+func TestResolveEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	existing := filepath.Join(dir, "existing")
+	if err := ioutil.WriteFile(existing, []byte("test"), 0644); err != nil {
+		t.Fatal("setup: ", err)
+	}
+	subdir := filepath.Join(dir, "subdir")
+	if err := os.Mkdir(subdir, 0755); err != nil {
+		t.Fatal("setup: ", err)
+	}
+	missing := filepath.Join(dir, "missing")
+	transient := filepath.Join(dir, "transient")
+
+	pending := map[string]fsnotify.Op{
+		existing:  fsnotify.Create | fsnotify.Write,
+		subdir:    fsnotify.Create,
+		missing:   fsnotify.Write | fsnotify.Rename,
+		transient: fsnotify.Create | fsnotify.Remove,
+	}
+	got := resolveEvents(pending)
+	want := []watchEvent{
+		{Name: existing, Op: fsnotify.Create},
+		{Name: missing, Op: fsnotify.Rename},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("resolveEvents(): got %d events; want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("resolveEvents(): got event %v; want %v", got[i], want[i])
+		}
+	}
+}
+
+func TestWatchRoutineDebounce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	batches := make(chan []watchEvent, 10)
+	wr, err := newWatchRoutine(dir, false, nil, 100*time.Millisecond, discardLogger{}, nil, func(events []watchEvent) {
+		batches <- events
+	})
+	if err != nil {
+		t.Fatal("setup: ", err)
+	}
+	defer wr.stop()
+
+	next := func() []watchEvent {
+		select {
+		case events := <-batches:
+			return events
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for events")
+			return nil
+		}
+	}
+
+	// Successive writes result in a single batch with a single event.
+	path := filepath.Join(dir, "index.html")
+	for i := 0; i < 3; i++ {
+		if err := ioutil.WriteFile(path, []byte("test"), 0644); err != nil {
+			t.Fatal("setup: ", err)
+		}
+	}
+	events := next()
+	if len(events) != 1 || events[0] != (watchEvent{Name: path, Op: fsnotify.Create}) {
+		t.Errorf("watchRoutine: got events %v; want a single creation of %q", events, path)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal("setup: ", err)
+	}
+	events = next()
+	if len(events) != 1 || events[0] != (watchEvent{Name: path, Op: fsnotify.Remove}) {
+		t.Errorf("watchRoutine: got events %v; want a single removal of %q", events, path)
+	}
+
+	select {
+	case events := <-batches:
+		t.Errorf("watchRoutine: got unexpected events %v", events)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
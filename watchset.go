@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// runningWatch is a watch, or an ilx watch, whose routine has been started.
+type runningWatch struct {
+	watch   *watchConfig // nil for ilx watches
+	ilx     *ilxConfig   // nil for watches
+	syncer  *syncer      // nil for ilx watches
+	routine *watchRoutine
+	rh      *routineHealth
+}
+
+// watchSet keeps track of the running watches so that only those affected by
+// a configuration change are restarted when the configuration is reloaded.
+type watchSet struct {
+	env     syncEnv
+	ctl     *controller
+	running map[string]*runningWatch // by watchKey
+}
+
+func newWatchSet(env syncEnv, ctl *controller) *watchSet {
+	return &watchSet{env: env, ctl: ctl, running: make(map[string]*runningWatch)}
+}
+
+func watchKey(kind, dir string) string {
+	return kind + ":" + dir
+}
+
+// apply starts the watches that are not running yet and restarts or stops
+// those whose configuration has changed or been removed. Every watch is
+// restarted when env differs from the current one, for instance when the
+// BigIP changed.
+func (ws *watchSet) apply(env syncEnv, watches []watchConfig, ilxs []ilxConfig) error {
+	want := make(map[string]*runningWatch)
+	for i := range watches {
+		key := watchKey("watch", watches[i].Dir)
+		if _, ok := want[key]; ok {
+			return fmt.Errorf("duplicate watch for directory %q", watches[i].Dir)
+		}
+		want[key] = &runningWatch{watch: &watches[i]}
+	}
+	for i := range ilxs {
+		key := watchKey("ilx", ilxs[i].Dir)
+		if _, ok := want[key]; ok {
+			return fmt.Errorf("duplicate ilx watch for directory %q", ilxs[i].Dir)
+		}
+		want[key] = &runningWatch{ilx: &ilxs[i]}
+	}
+
+	restartAll := env.f5Client != ws.env.f5Client || env.target != ws.env.target
+	ws.env = env
+
+	var errs []string
+	for _, key := range sortedRunningKeys(ws.running) {
+		rw := ws.running[key]
+		if nw, ok := want[key]; ok && !restartAll && sameWatch(rw, nw) {
+			continue
+		}
+		if err := ws.stop(key); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, key := range sortedRunningKeys(want) {
+		if _, ok := ws.running[key]; ok {
+			continue
+		}
+		if err := ws.start(key, want[key]); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func sameWatch(a, b *runningWatch) bool {
+	if a.watch != nil {
+		return b.watch != nil && reflect.DeepEqual(*a.watch, *b.watch)
+	}
+	return b.ilx != nil && reflect.DeepEqual(*a.ilx, *b.ilx)
+}
+
+func sortedRunningKeys(m map[string]*runningWatch) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// start synchronises the directory of rw and then starts watching it.
+func (ws *watchSet) start(key string, rw *runningWatch) error {
+	var err error
+	if rw.watch != nil {
+		err = ws.startWatch(rw)
+	} else {
+		err = ws.startILX(rw)
+	}
+	if err != nil {
+		if rw.rh != nil {
+			healthState.unregister(rw.rh)
+		}
+		if rw.syncer != nil {
+			ws.ctl.remove(rw.syncer)
+			stats.unregisterRetryQueue(rw.watch.Dir)
+		}
+		return err
+	}
+	ws.running[key] = rw
+	return nil
+}
+
+func (ws *watchSet) startWatch(rw *runningWatch) error {
+	cfg := *rw.watch
+	s, err := newSyncer(ws.env, cfg)
+	if err != nil {
+		return fmt.Errorf("invalid watch configuration for directory %q: %v", cfg.Dir, err)
+	}
+	rw.syncer = s
+	ws.ctl.add(s)
+	rw.rh = healthState.register("watch", cfg.Dir, s.retries)
+	if err := scanDir(s); err != nil {
+		return fmt.Errorf("cannot scan directory %q: %v", cfg.Dir, err)
+	}
+	healthState.setScanned(rw.rh)
+	if rw.routine, err = watchDir(s); err != nil {
+		return err
+	}
+	healthState.setRoutine(rw.rh, rw.routine)
+	return nil
+}
+
+func (ws *watchSet) startILX(rw *runningWatch) error {
+	cfg := *rw.ilx
+	filter, err := newFileFilter(cfg.Dir, false, cfg.Include, cfg.Exclude, ws.env.l)
+	if err != nil {
+		return fmt.Errorf("invalid ilx configuration for directory %q: %v", cfg.Dir, err)
+	}
+	rw.rh = healthState.register("ilx", cfg.Dir, nil)
+	if err := syncILX(ws.env.f5Client, ws.env.l, cfg, filter); err != nil {
+		return fmt.Errorf("cannot synchronise directory %q with ilx workspace %q: %v", cfg.Dir, cfg.Workspace, err)
+	}
+	healthState.setScanned(rw.rh)
+	if rw.routine, err = watchILX(ws.env.f5Client, ws.env.l, cfg, filter); err != nil {
+		return err
+	}
+	healthState.setRoutine(rw.rh, rw.routine)
+	return nil
+}
+
+// stop stops the routine of the running watch identified by key.
+func (ws *watchSet) stop(key string) error {
+	rw := ws.running[key]
+	delete(ws.running, key)
+	ws.env.l.Noticef("stopping routine %q", key)
+	err := rw.routine.stop()
+	healthState.unregister(rw.rh)
+	if rw.syncer != nil {
+		ws.ctl.remove(rw.syncer)
+		stats.unregisterRetryQueue(rw.watch.Dir)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot stop routine %q: %v", key, err)
+	}
+	return nil
+}
+
+// stopAll stops all the running watches.
+func (ws *watchSet) stopAll() {
+	for _, key := range sortedRunningKeys(ws.running) {
+		if err := ws.stop(key); err != nil {
+			ws.env.l.Error(err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWatchSet_Apply(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "f5-auto-uploader-test")
+		if err != nil {
+			t.Fatal("setup: ", err)
+		}
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+
+	env := syncEnv{target: "https://bigip", l: discardLogger{}}
+	ws := newWatchSet(env, &controller{})
+	var cfgs []watchConfig
+	for _, dir := range dirs {
+		wr, err := newWatchRoutine(dir, false, nil, 0, discardLogger{}, nil, func([]watchEvent) {})
+		if err != nil {
+			t.Fatal("setup: ", err)
+		}
+		cfg := watchConfig{Dir: dir, Exclude: []string{".*"}}
+		cfgs = append(cfgs, cfg)
+		ws.running[watchKey("watch", dir)] = &runningWatch{
+			watch:   &cfg,
+			routine: wr,
+			rh:      healthState.register("watch", dir, nil),
+		}
+	}
+	kept := ws.running[watchKey("watch", dirs[0])]
+	removed := ws.running[watchKey("watch", dirs[1])]
+
+	// Only the watch which is not part of the configuration anymore must be
+	// stopped.
+	if err := ws.apply(env, []watchConfig{{Dir: dirs[0], Exclude: []string{".*"}}}, nil); err != nil {
+		t.Fatalf("watchSet.apply(): unexpected error %q", err.Error())
+	}
+	if !kept.routine.alive() {
+		t.Errorf("watchSet.apply(): unchanged watch %q has been stopped", dirs[0])
+	}
+	if removed.routine.alive() {
+		t.Errorf("watchSet.apply(): removed watch %q is still running", dirs[1])
+	}
+	if got := len(ws.running); got != 1 {
+		t.Errorf("watchSet.apply(): got %d running watches; want 1", got)
+	}
+	ws.stopAll()
+	if kept.routine.alive() {
+		t.Errorf("watchSet.stopAll(): watch %q is still running", dirs[0])
+	}
+
+	err := ws.apply(env, []watchConfig{cfgs[0], cfgs[0]}, nil)
+	if err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("watchSet.apply() with duplicate watches: got %v; want duplicate error", err)
+	}
+}
+
+func TestSameWatch(t *testing.T) {
+	a := &runningWatch{watch: &watchConfig{Dir: "/tmp/test", Exclude: []string{".*"}}}
+	b := &runningWatch{watch: &watchConfig{Dir: "/tmp/test", Exclude: []string{".*"}}}
+	if !sameWatch(a, b) {
+		t.Error("sameWatch(): got false for identical watches; want true")
+	}
+	b.watch.ForceDelete = true
+	if sameWatch(a, b) {
+		t.Error("sameWatch(): got true for different watches; want false")
+	}
+	if sameWatch(a, &runningWatch{ilx: &ilxConfig{Dir: "/tmp/test"}}) {
+		t.Error("sameWatch(): got true for a watch and an ilx watch; want false")
+	}
+}